@@ -0,0 +1,186 @@
+package egress
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// maxNumberExponent bounds the exponent of JSON numbers, so that the exponent arithmetic in normalizeNumber
+// can't overflow. Numbers with bigger exponents are rejected
+const maxNumberExponent = 1 << 30
+
+// CanonicalJSON serializes the value into canonical JSON: object keys are sorted, insignificant whitespace
+// is dropped and numbers are normalized, so 1, 1.0 and 1e0 are all serialized as 1.
+// Logically equal values always produce the same output
+func CanonicalJSON(value any) ([]byte, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	// Round-trip the value through JSON so that only JSON types have to be handled below
+	// and numbers are kept as they were written
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var decoded any
+	if err := decoder.Decode(&decoded); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := writeCanonicalJSON(&buf, decoded); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeCanonicalJSON writes a value decoded with json.Decoder.UseNumber as canonical JSON
+func writeCanonicalJSON(buf *bytes.Buffer, value any) error {
+	switch v := value.(type) {
+	case nil:
+		buf.WriteString("null")
+	case bool:
+		if v {
+			buf.WriteString("true")
+		} else {
+			buf.WriteString("false")
+		}
+	case string:
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		buf.Write(data)
+	case json.Number:
+		number, err := normalizeNumber(v)
+		if err != nil {
+			return err
+		}
+		buf.WriteString(number)
+	case []any:
+		buf.WriteByte('[')
+		for i, elem := range v {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := writeCanonicalJSON(buf, elem); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		buf.WriteByte('{')
+		for i, key := range keys {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := writeCanonicalJSON(buf, key); err != nil {
+				return err
+			}
+			buf.WriteByte(':')
+			if err := writeCanonicalJSON(buf, v[key]); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	default:
+		return fmt.Errorf("unexpected JSON value type %T", value)
+	}
+	return nil
+}
+
+// normalizeNumber returns the shortest representation of a JSON number. It is built from the decimal text
+// of the number, so numbers are kept exact and huge exponents take no longer than small ones. The number
+// has to be valid JSON, which is guaranteed for the numbers produced by json.Decoder
+func normalizeNumber(number json.Number) (string, error) {
+	text := number.String()
+	negative := strings.HasPrefix(text, "-")
+	mantissa, exponentText, hasExponent := strings.Cut(strings.TrimPrefix(text, "-"), "e")
+	if !hasExponent {
+		mantissa, exponentText, hasExponent = strings.Cut(mantissa, "E")
+	}
+	intPart, fracPart, _ := strings.Cut(mantissa, ".")
+
+	var exponent int64
+	if hasExponent {
+		var err error
+		exponent, err = strconv.ParseInt(exponentText, 10, 64)
+		if err != nil || exponent > maxNumberExponent || exponent < -maxNumberExponent {
+			return "", fmt.Errorf("number exponent out of range: %v", text)
+		}
+	}
+
+	// The number is digits * 10^exponent, with the leading and trailing zeros of digits dropped
+	digits := strings.TrimLeft(intPart+fracPart, "0")
+	if digits == "" {
+		// -0 and 0 are the same
+		return "0", nil
+	}
+	exponent -= int64(len(fracPart))
+	trimmed := strings.TrimRight(digits, "0")
+	exponent += int64(len(digits) - len(trimmed))
+	digits = trimmed
+	// Position of the decimal point relative to the first digit
+	point := int64(len(digits)) + exponent
+
+	var buf strings.Builder
+	if negative {
+		buf.WriteByte('-')
+	}
+	switch {
+	case exponent >= 0 && point <= 21:
+		buf.WriteString(digits)
+		buf.WriteString(strings.Repeat("0", int(exponent)))
+	case exponent < 0 && point > 0:
+		buf.WriteString(digits[:point])
+		buf.WriteByte('.')
+		buf.WriteString(digits[point:])
+	case exponent < 0 && point > -6:
+		buf.WriteString("0.")
+		buf.WriteString(strings.Repeat("0", int(-point)))
+		buf.WriteString(digits)
+	default:
+		buf.WriteString(digits[:1])
+		if len(digits) > 1 {
+			buf.WriteByte('.')
+			buf.WriteString(digits[1:])
+		}
+		buf.WriteByte('e')
+		if point > 0 {
+			buf.WriteByte('+')
+		}
+		buf.WriteString(strconv.FormatInt(point-1, 10))
+	}
+	return buf.String(), nil
+}
+
+// validateNumbers checks that every number in a value decoded with json.Decoder.UseNumber can be normalized
+func validateNumbers(value any) error {
+	switch v := value.(type) {
+	case json.Number:
+		_, err := normalizeNumber(v)
+		return err
+	case []any:
+		for _, elem := range v {
+			if err := validateNumbers(elem); err != nil {
+				return err
+			}
+		}
+	case map[string]any:
+		for _, elem := range v {
+			if err := validateNumbers(elem); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
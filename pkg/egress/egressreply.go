@@ -0,0 +1,129 @@
+package egress
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+// EgressReplyVersion is the version of the EgressReply format. Ingress rejects replies of other versions
+const EgressReplyVersion int = 1
+
+// ReplyStatus tells how the request was handled by egress
+type ReplyStatus string
+
+const (
+	// ReplyStatusOK means jrpcserver returned a result
+	ReplyStatusOK ReplyStatus = "ok"
+	// ReplyStatusBackendError means jrpcserver returned an error response
+	ReplyStatusBackendError ReplyStatus = "backendError"
+	// ReplyStatusRelayError means egress did not get a response from jrpcserver, see RelayErrorClass
+	ReplyStatusRelayError ReplyStatus = "relayError"
+)
+
+// RelayErrorClass classifies the errors of egress itself
+type RelayErrorClass string
+
+const (
+	// RelayErrorRejected means the request was rejected by egress: it is not well formed, calls a method
+	// which is not enabled or has invalid params
+	RelayErrorRejected RelayErrorClass = "rejected"
+	// RelayErrorBackendUnavailable means jrpcserver could not be reached or replied with something
+	// other than a JSON-RPC response
+	RelayErrorBackendUnavailable RelayErrorClass = "backendUnavailable"
+	// RelayErrorInternal means egress failed to handle the request
+	RelayErrorInternal RelayErrorClass = "internal"
+)
+
+// EgressReply is the envelope egress replies to ingress requests with
+type EgressReply struct {
+	Version int         `json:"version"`
+	Status  ReplyStatus `json:"status"`
+	// Only set for ReplyStatusRelayError
+	ErrorClass RelayErrorClass `json:"errorClass,omitempty"`
+	// JSON-RPC response or error response for the user
+	Response json.RawMessage `json:"response"`
+	// Time spent waiting for jrpcserver
+	BackendDuration time.Duration `json:"backendDuration,omitempty"`
+}
+
+// internalErrorResponse is returned when a response can't be encoded
+var internalErrorResponse = json.RawMessage(fmt.Sprintf(
+	`{"jsonrpc":"2.0","id":null,"error":{"code":%d,"message":"%v"}}`,
+	RPCErrorInternalError, errorResponseMap[RPCErrorInternalError]))
+
+// NewEgressReply wraps the JSON-RPC response into an EgressReply. An errorClass has to be given
+// for ReplyStatusRelayError
+func NewEgressReply(status ReplyStatus, errorClass RelayErrorClass, response any) *EgressReply {
+	encoded, err := json.Marshal(response)
+	if err != nil {
+		log.Errorln("Error during JSON response encoding", err)
+		status, errorClass, encoded = ReplyStatusRelayError, RelayErrorInternal, internalErrorResponse
+	}
+	return &EgressReply{
+		Version:    EgressReplyVersion,
+		Status:     status,
+		ErrorClass: errorClass,
+		Response:   encoded,
+	}
+}
+
+// ParseEgressReply parses a reply received from egress and checks its version and status
+func ParseEgressReply(data []byte) (*EgressReply, error) {
+	var reply EgressReply
+	if err := json.Unmarshal(data, &reply); err != nil {
+		return nil, err
+	}
+	if reply.Version != EgressReplyVersion {
+		return nil, fmt.Errorf("unsupported egress reply version %d", reply.Version)
+	}
+
+	switch reply.Status {
+	case ReplyStatusOK, ReplyStatusBackendError:
+	case ReplyStatusRelayError:
+		switch reply.ErrorClass {
+		case RelayErrorRejected, RelayErrorBackendUnavailable, RelayErrorInternal:
+		default:
+			return nil, fmt.Errorf("unknown egress relay error class %q", reply.ErrorClass)
+		}
+	default:
+		return nil, fmt.Errorf("unknown egress reply status %q", reply.Status)
+	}
+	return &reply, nil
+}
+
+// GetResponse parses the JSON-RPC response carried by the reply
+func (reply *EgressReply) GetResponse() (*RPCRawResponse, error) {
+	response, err := ParseRawResponse(reply.Response)
+	if err != nil {
+		return nil, err
+	}
+	if (reply.Status == ReplyStatusOK) == response.IsError() {
+		return nil, fmt.Errorf("egress reply status %q does not match the response", reply.Status)
+	}
+	if response.IsError() {
+		if _, err := response.GetError(); err != nil {
+			return nil, err
+		}
+	}
+	return response, nil
+}
+
+// IsFailure checks whether the request failed for reasons other than the request itself: egress or
+// jrpcserver failed to handle it. Such replies are not cached
+func (reply *EgressReply) IsFailure() bool {
+	switch reply.Status {
+	case ReplyStatusRelayError:
+		return reply.ErrorClass != RelayErrorRejected
+	case ReplyStatusBackendError:
+		var response struct {
+			Error *RPCError `json:"error"`
+		}
+		if err := json.Unmarshal(reply.Response, &response); err != nil || response.Error == nil {
+			return true
+		}
+		return response.Error.Code == RPCErrorInternalError
+	}
+	return false
+}
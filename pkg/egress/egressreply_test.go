@@ -0,0 +1,60 @@
+package egress
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParseEgressReply(t *testing.T) {
+	reply, err := ParseEgressReply([]byte(
+		`{"version": 1, "status": "ok", "response": {"jsonrpc": "2.0", "id": 1, "result": 3}, "backendDuration": 1000}`))
+	assert.NoError(t, err)
+	assert.Equal(t, ReplyStatusOK, reply.Status)
+	resp, err := reply.GetResponse()
+	assert.NoError(t, err)
+	assert.Equal(t, "3", string(resp.Result))
+	assert.False(t, reply.IsFailure())
+
+	invalid := []string{
+		`{bad`,
+		`{"jsonrpc": "2.0", "id": 1, "result": 3}`,
+		`{"version": 2, "status": "ok", "response": {"jsonrpc": "2.0", "id": 1, "result": 3}}`,
+		`{"version": 1, "status": "unknown", "response": {"jsonrpc": "2.0", "id": 1, "result": 3}}`,
+		`{"version": 1, "status": "relayError", "response": {"jsonrpc": "2.0", "id": 1, "error": {}}}`,
+	}
+	for _, data := range invalid {
+		_, err := ParseEgressReply([]byte(data))
+		assert.Error(t, err, data)
+	}
+}
+
+func TestEgressReply_GetResponse(t *testing.T) {
+	mismatched := []*EgressReply{
+		NewEgressReply(ReplyStatusOK, "", CreateErrorResponse(1, RPCErrorInternalError)),
+		NewEgressReply(ReplyStatusBackendError, "", CreateResponse(3, NewDummyRPCRequest())),
+		{Version: EgressReplyVersion, Status: ReplyStatusOK, Response: []byte(`{"jsonrpc": "2.0"}`)},
+		{Version: EgressReplyVersion, Status: ReplyStatusOK, Response: []byte(`[1]`)},
+		{Version: EgressReplyVersion, Status: ReplyStatusBackendError, Response: []byte(`{"error": []}`)},
+	}
+	for _, reply := range mismatched {
+		_, err := reply.GetResponse()
+		assert.Error(t, err)
+	}
+}
+
+func TestEgressReply_IsFailure(t *testing.T) {
+	cases := []struct {
+		reply   *EgressReply
+		failure bool
+	}{
+		{NewEgressReply(ReplyStatusOK, "", CreateResponse(3, NewDummyRPCRequest())), false},
+		{NewEgressReply(ReplyStatusBackendError, "", CreateErrorResponse(1, RPCErrorInvalidParams)), false},
+		{NewEgressReply(ReplyStatusBackendError, "", CreateErrorResponse(1, RPCErrorInternalError)), true},
+		{NewEgressReply(ReplyStatusRelayError, RelayErrorRejected, CreateErrorResponse(1, RPCErrorInvalidParams)), false},
+		{NewEgressReply(ReplyStatusRelayError, RelayErrorBackendUnavailable, CreateErrorResponse(1, RPCErrorInternalError)), true},
+		{NewEgressReply(ReplyStatusRelayError, RelayErrorInternal, CreateErrorResponse(1, RPCErrorInternalError)), true},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.failure, c.reply.IsFailure(), string(c.reply.Response))
+	}
+}
@@ -0,0 +1,33 @@
+package egress
+
+import (
+	"encoding/json"
+	"github.com/nats-io/nats.go"
+)
+
+// NATS headers set by ingress
+const (
+	// Name of the caller authenticated by ingress
+	CallerHeader string = "Rpc-Relay-Caller"
+)
+
+// NewRequestMsg creates a NATS message carrying the request to egress. Headers are only set if
+// there is something to pass, so that NATS servers without header support keep working
+func NewRequestMsg(subject string, request *RPCRequest) (*nats.Msg, error) {
+	data, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	msg := nats.NewMsg(subject)
+	msg.Data = data
+	if request.Caller != "" {
+		msg.Header.Set(CallerHeader, request.Caller)
+	}
+	return msg, nil
+}
+
+// GetCaller returns the name of the caller of the request carried by the NATS message, or an empty
+// string if ingress did not authenticate it
+func GetCaller(msg *nats.Msg) string {
+	return msg.Header.Get(CallerHeader)
+}
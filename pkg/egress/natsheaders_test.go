@@ -0,0 +1,25 @@
+package egress
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestNewRequestMsg(t *testing.T) {
+	req := NewDummyRPCRequest()
+	msg, err := NewRequestMsg("rpc.module.method", req)
+	assert.NoError(t, err)
+	assert.Equal(t, "rpc.module.method", msg.Subject)
+	assert.Empty(t, msg.Header)
+	assert.Empty(t, GetCaller(msg))
+
+	parsed, err := ParseCall(msg.Data)
+	assert.NoError(t, err)
+	assert.Equal(t, req.Method, parsed.Method)
+
+	req.Caller = "team"
+	msg, err = NewRequestMsg("rpc.module.method", req)
+	assert.NoError(t, err)
+	assert.Equal(t, "team", GetCaller(msg))
+	assert.NotContains(t, string(msg.Data), "team")
+}
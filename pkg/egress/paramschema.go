@@ -0,0 +1,149 @@
+package egress
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/parkanaur/rpc-relay/pkg/relayutil"
+	"math"
+	"unicode/utf8"
+)
+
+// Parameter types used in the parameter schema
+const (
+	RPCParamTypeNumber  string = "number"
+	RPCParamTypeInteger string = "integer"
+	RPCParamTypeString  string = "string"
+	RPCParamTypeBoolean string = "boolean"
+	RPCParamTypeArray   string = "array"
+	RPCParamTypeObject  string = "object"
+)
+
+// ValidateParams checks the params against the parameter schema of the method: their number, names, types
+// and values. Methods without a schema accept any params, except for numbers which can't be normalized
+// for the request key (see GetRequestKey)
+func (call *RPCRequest) ValidateParams(schema *relayutil.RPCMethodSchema) error {
+	if err := validateNumbers(call.Params); err != nil {
+		return err
+	}
+	if err := validateNumbers(call.NamedParams); err != nil {
+		return err
+	}
+	if schema == nil {
+		return nil
+	}
+
+	if call.NamedParams != nil {
+		for name := range call.NamedParams {
+			if schema.GetParamIndex(name) < 0 {
+				return fmt.Errorf("unknown param %q", name)
+			}
+		}
+		for _, param := range schema.Params {
+			value, ok := call.NamedParams[param.Name]
+			if err := validateParam(param, value, ok); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if len(call.Params) > len(schema.Params) {
+		return fmt.Errorf("too many params: expected at most %d, got %d", len(schema.Params), len(call.Params))
+	}
+	for i, param := range schema.Params {
+		var value any
+		if i < len(call.Params) {
+			value = call.Params[i]
+		}
+		if err := validateParam(param, value, i < len(call.Params)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateParam checks a single param value against its schema. isSet is false for omitted params
+func validateParam(param *relayutil.RPCParamSchema, value any, isSet bool) error {
+	if !isSet || value == nil {
+		if param.Optional {
+			return nil
+		}
+		return fmt.Errorf("missing required param %q", param.Name)
+	}
+
+	switch param.Type {
+	case "":
+	case RPCParamTypeNumber, RPCParamTypeInteger:
+		number, ok := getNumber(value)
+		if !ok || (param.Type == RPCParamTypeInteger && number != math.Trunc(number)) {
+			return fmt.Errorf("param %q must be of type %v", param.Name, param.Type)
+		}
+		if param.Minimum != nil && number < *param.Minimum {
+			return fmt.Errorf("param %q must be at least %v", param.Name, *param.Minimum)
+		}
+		if param.Maximum != nil && number > *param.Maximum {
+			return fmt.Errorf("param %q must be at most %v", param.Name, *param.Maximum)
+		}
+	case RPCParamTypeString:
+		str, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("param %q must be of type %v", param.Name, param.Type)
+		}
+		length := utf8.RuneCountInString(str)
+		if param.MinLength != nil && length < *param.MinLength {
+			return fmt.Errorf("param %q must be at least %d characters long", param.Name, *param.MinLength)
+		}
+		if param.MaxLength != nil && length > *param.MaxLength {
+			return fmt.Errorf("param %q must be at most %d characters long", param.Name, *param.MaxLength)
+		}
+	case RPCParamTypeBoolean:
+		if _, ok := value.(bool); !ok {
+			return fmt.Errorf("param %q must be of type %v", param.Name, param.Type)
+		}
+	case RPCParamTypeArray:
+		if _, ok := value.([]any); !ok {
+			return fmt.Errorf("param %q must be of type %v", param.Name, param.Type)
+		}
+	case RPCParamTypeObject:
+		if _, ok := value.(map[string]any); !ok {
+			return fmt.Errorf("param %q must be of type %v", param.Name, param.Type)
+		}
+	default:
+		return fmt.Errorf("param %q has unknown type %q in schema", param.Name, param.Type)
+	}
+
+	if len(param.Enum) > 0 && !isEnumValue(param.Enum, value) {
+		return fmt.Errorf("param %q must be one of %v", param.Name, param.Enum)
+	}
+	return nil
+}
+
+// getNumber converts a number param to float64
+func getNumber(value any) (float64, bool) {
+	switch v := value.(type) {
+	case json.Number:
+		number, err := v.Float64()
+		return number, err == nil
+	case float64:
+		return v, true
+	case int:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+// isEnumValue checks whether the value is logically equal to one of the enum values
+func isEnumValue(enum []any, value any) bool {
+	canonicalValue, err := CanonicalJSON(value)
+	if err != nil {
+		return false
+	}
+	for _, enumValue := range enum {
+		canonicalEnumValue, err := CanonicalJSON(enumValue)
+		if err == nil && bytes.Equal(canonicalValue, canonicalEnumValue) {
+			return true
+		}
+	}
+	return false
+}
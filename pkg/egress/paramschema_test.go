@@ -0,0 +1,67 @@
+package egress
+
+import (
+	"github.com/parkanaur/rpc-relay/pkg/relayutil"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func NewDummyMethodSchema() *relayutil.RPCMethodSchema {
+	minimum, maximum := 0.0, 10.0
+	maxLength := 3
+	return &relayutil.RPCMethodSchema{Params: []*relayutil.RPCParamSchema{
+		{Name: "count", Type: RPCParamTypeInteger, Minimum: &minimum, Maximum: &maximum},
+		{Name: "name", Type: RPCParamTypeString, MaxLength: &maxLength},
+		{Name: "mode", Type: RPCParamTypeString, Optional: true, Enum: []any{"fast", "slow"}},
+	}}
+}
+
+func TestRPCRequest_ValidateParams(t *testing.T) {
+	valid := []string{
+		`[1, "abc"]`,
+		`[10.0, "фыв", "slow"]`,
+		`[0, "", null]`,
+		`{"name": "a", "count": 5}`,
+		`{"name": "a", "count": 5, "mode": "fast"}`,
+	}
+	for _, params := range valid {
+		call, err := ParseCall([]byte(`{"id": 1, "jsonrpc": "2.0", "method": "dummyModule_dummyMethod", "params": ` + params + `}`))
+		assert.NoError(t, err)
+		assert.NoError(t, call.ValidateParams(NewDummyMethodSchema()), params)
+	}
+
+	invalid := map[string]string{
+		`[1]`:                          `missing required param "name"`,
+		`[1, "a", "fast", 4]`:          `too many params: expected at most 3, got 4`,
+		`["1", "a"]`:                   `param "count" must be of type integer`,
+		`[1.5, "a"]`:                   `param "count" must be of type integer`,
+		`[-1, "a"]`:                    `param "count" must be at least 0`,
+		`[11, "a"]`:                    `param "count" must be at most 10`,
+		`[1, "abcd"]`:                  `param "name" must be at most 3 characters long`,
+		`[1, 2]`:                       `param "name" must be of type string`,
+		`[1, "a", "medium"]`:           `param "mode" must be one of [fast slow]`,
+		`{"count": 1, "other": "a"}`:   `unknown param "other"`,
+		`{"count": 1, "mode": "slow"}`: `missing required param "name"`,
+	}
+	for params, message := range invalid {
+		call, err := ParseCall([]byte(`{"id": 1, "jsonrpc": "2.0", "method": "dummyModule_dummyMethod", "params": ` + params + `}`))
+		assert.NoError(t, err)
+		assert.EqualError(t, call.ValidateParams(NewDummyMethodSchema()), message, params)
+	}
+
+	call := NewDummyRPCRequest()
+	assert.NoError(t, call.ValidateParams(nil))
+}
+
+func TestRPCRequest_ValidateParamsNumbers(t *testing.T) {
+	for _, params := range []string{`[1e1073741825]`, `{"a": [1e9999999999999]}`, `[1e-99999999999999999999]`} {
+		call, err := ParseCall([]byte(`{"id": 1, "jsonrpc": "2.0", "method": "dummyModule_dummyMethod", "params": ` + params + `}`))
+		assert.NoError(t, err)
+		// Numbers which can't be normalized are rejected even without a schema
+		assert.Error(t, call.ValidateParams(nil), params)
+	}
+
+	call, err := ParseCall([]byte(`{"id": 1, "jsonrpc": "2.0", "method": "dummyModule_dummyMethod", "params": [1e100000000, 2]}`))
+	assert.NoError(t, err)
+	assert.NoError(t, call.ValidateParams(nil))
+}
@@ -1,8 +1,13 @@
 package egress
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/parkanaur/rpc-relay/pkg/relayutil"
 	"strings"
 )
 
@@ -13,32 +18,121 @@ type RPCRequest struct {
 	// Second part of the method name ("calculateSum1_calculateSum") -> "calculateSum"
 	MethodName string `json:"-"`
 
-	// JSONRPC spec fields
-	Params  []any  `json:"params"`
-	ID      any    `json:"id"`
-	Method  string `json:"method"`
-	JSONRPC string `json:"jsonrpc"`
+	// Set for requests without the "id" member. The spec defines them as notifications which must not
+	// be replied to
+	IsNotification bool `json:"-"`
+	// Name of the authenticated caller. It is passed to egress in the CallerHeader NATS header rather
+	// than in the request. Empty if authentication is disabled
+	Caller string `json:"-"`
+
+	// JSONRPC spec fields. Params holds positional (array) params and NamedParams holds by-name (object)
+	// params, at most one of them is set
+	Params      []any
+	NamedParams map[string]any
+	ID          any
+	Method      string
+	JSONRPC     string
+}
+
+// ErrInvalidID is returned by ParseCall for requests whose id is not a string, a number or null
+var ErrInvalidID = errors.New("id must be a string, a number or null")
+
+// rpcRequestJSON is the JSON representation of RPCRequest
+type rpcRequestJSON struct {
+	Params  json.RawMessage `json:"params,omitempty"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	JSONRPC string          `json:"jsonrpc"`
+}
+
+// decodeJSON unmarshals the data keeping numbers as they were written, so that big integers
+// do not lose precision
+func decodeJSON(data []byte, value any) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode(value)
+}
+
+// UnmarshalJSON accepts both positional and named params
+func (call *RPCRequest) UnmarshalJSON(data []byte) error {
+	var rawCall rpcRequestJSON
+	if err := json.Unmarshal(data, &rawCall); err != nil {
+		return err
+	}
+
+	*call = RPCRequest{Method: rawCall.Method, JSONRPC: rawCall.JSONRPC}
+	// "id": null is a valid (although discouraged) id, while a request without the "id" member at all
+	// is a notification
+	call.IsNotification = rawCall.ID == nil
+	if rawCall.ID != nil {
+		if err := decodeJSON(rawCall.ID, &call.ID); err != nil {
+			return err
+		}
+		switch call.ID.(type) {
+		case nil, string, json.Number:
+		default:
+			return ErrInvalidID
+		}
+	}
+
+	params := bytes.TrimLeft(rawCall.Params, " \t\r\n")
+	switch {
+	case len(params) == 0 || bytes.Equal(params, []byte("null")):
+	case params[0] == '[':
+		return decodeJSON(params, &call.Params)
+	case params[0] == '{':
+		return decodeJSON(params, &call.NamedParams)
+	default:
+		return fmt.Errorf("params must be an array or an object")
+	}
+	return nil
+}
+
+// MarshalJSON encodes the params in the form they were received in. The id is omitted for notifications
+func (call *RPCRequest) MarshalJSON() ([]byte, error) {
+	rawCall := rpcRequestJSON{Method: call.Method, JSONRPC: call.JSONRPC}
+
+	var err error
+	if call.NamedParams != nil {
+		rawCall.Params, err = json.Marshal(call.NamedParams)
+	} else {
+		rawCall.Params, err = json.Marshal(call.Params)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !call.IsNotification {
+		if rawCall.ID, err = json.Marshal(call.ID); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(&rawCall)
 }
 
 // GetRequestKey returns a string to be used as a request cache key. The key uniquely identifies
-// the request by its method name and parameters
+// the request by its method name and parameters. It is the hex-encoded SHA-256 hash of the canonical JSON
+// of the method name and the parameters, so logically equal calls get the same key
 // calculateSum(1,2) is different from calculateSum(2,1)
 // calculateSum("1", 2) is different from calculateSum(1, 2)
+// calculateSum(1.0, 2) is the same as calculateSum(1, 2)
 func (call *RPCRequest) GetRequestKey() string {
-	var sb strings.Builder
-	sb.WriteString(call.Method)
-
-	for _, v := range call.Params {
-		var writeFmt string
-		if _, ok := v.(string); ok {
-			writeFmt = "%q"
-		} else {
-			writeFmt = "%#v"
-		}
-		sb.WriteString(fmt.Sprintf(writeFmt, v))
+	var params any = call.Params
+	if call.NamedParams != nil {
+		params = call.NamedParams
+	} else if call.Params == nil {
+		// Omitted params are the same as no params
+		params = []any{}
+	}
+	// Encoding both values as a single JSON array keeps the boundary between them unambiguous
+	key, err := CanonicalJSON([]any{call.Method, params})
+	if err != nil {
+		// Only possible for params which can't be encoded as JSON or numbers rejected by ValidateParams.
+		// Such requests are not supposed to be cached
+		key = []byte(fmt.Sprintf("%q%#v", call.Method, params))
 	}
 
-	return sb.String()
+	hash := sha256.Sum256(key)
+	return hex.EncodeToString(hash[:])
 }
 
 // GetFullMethodName forms a full method name from its module/method parts
@@ -53,9 +147,6 @@ func ParseCall(data []byte) (*RPCRequest, error) {
 		return nil, err
 	}
 	// JSONRPC specific checks
-	if call.ID == nil {
-		return nil, fmt.Errorf("missing ID field")
-	}
 	if call.JSONRPC != "2.0" {
 		return nil, fmt.Errorf("bad jsonrpc field")
 	}
@@ -69,7 +160,88 @@ func ParseCall(data []byte) (*RPCRequest, error) {
 	call.ModuleName = s[0]
 	call.MethodName = s[1]
 
-	// TODO: Param checking for a given method based on types defined in config
-
 	return &call, nil
 }
+
+// GetPositionalParams returns the params in positional order. Named params are mapped to positions
+// using the parameter schema of the method. Params missing in the middle are passed as nulls, and params
+// missing at the end are omitted, so that go-ethereum treats them as optional
+func (call *RPCRequest) GetPositionalParams(schema *relayutil.RPCMethodSchema) ([]any, error) {
+	if call.NamedParams == nil {
+		return call.Params, nil
+	}
+	if schema == nil {
+		return nil, fmt.Errorf("named params are not supported by %v", call.Method)
+	}
+
+	for name := range call.NamedParams {
+		if schema.GetParamIndex(name) < 0 {
+			return nil, fmt.Errorf("unknown param %q", name)
+		}
+	}
+	params := make([]any, len(schema.Params))
+	for i, param := range schema.Params {
+		params[i] = call.NamedParams[param.Name]
+	}
+
+	// Trimming the params missing at the end
+	last := len(params)
+	for last > 0 {
+		if _, ok := call.NamedParams[schema.Params[last-1].Name]; ok {
+			break
+		}
+		last--
+	}
+	return params[:last], nil
+}
+
+// GetParseErrorNum returns the JSON-RPC error for a request ParseCall failed on. Requests with
+// an invalid id are well-formed but invalid
+func GetParseErrorNum(err error) RPCErrorNum {
+	if errors.Is(err, ErrInvalidID) {
+		return RPCErrorInvalidRequest
+	}
+	return RPCErrorNotWellFormed
+}
+
+// ParseRequestID extracts the id from a request which may be invalid otherwise, so that an error response
+// can be addressed to it. Returns nil if the data is not a JSON object or has no valid id
+func ParseRequestID(data []byte) any {
+	var rawCall rpcRequestJSON
+	if err := json.Unmarshal(data, &rawCall); err != nil || rawCall.ID == nil {
+		return nil
+	}
+	var id any
+	if err := decodeJSON(rawCall.ID, &id); err != nil {
+		return nil
+	}
+	// The spec only allows strings, numbers and null as ids
+	switch id.(type) {
+	case string, json.Number:
+		return id
+	}
+	return nil
+}
+
+// IsBatch checks whether the incoming data is a JSON-RPC 2.0 batch, i.e. a JSON array of requests
+func IsBatch(data []byte) bool {
+	trimmed := bytes.TrimLeft(data, " \t\r\n")
+	return len(trimmed) > 0 && trimmed[0] == '['
+}
+
+// IsObject checks whether the incoming data is a JSON object. Batch elements which are not objects
+// are not requests at all
+func IsObject(data []byte) bool {
+	trimmed := bytes.TrimLeft(data, " \t\r\n")
+	return len(trimmed) > 0 && trimmed[0] == '{'
+}
+
+// ParseBatch splits an incoming batch into separate raw requests. Each of them is supposed to be
+// parsed with ParseCall afterwards so that a single bad request does not fail the whole batch
+func ParseBatch(data []byte) ([]json.RawMessage, error) {
+	var calls []json.RawMessage
+	if err := json.Unmarshal(data, &calls); err != nil {
+		return nil, err
+	}
+	return calls, nil
+}
@@ -1,7 +1,9 @@
 package egress
 
 import (
+	"encoding/json"
 	"github.com/google/go-cmp/cmp"
+	"github.com/parkanaur/rpc-relay/pkg/relayutil"
 	"github.com/stretchr/testify/assert"
 	"testing"
 )
@@ -19,30 +21,106 @@ func NewDummyRPCRequest() *RPCRequest {
 
 func TestRPCRequest_GetRequestKeyIntParams(t *testing.T) {
 	r := NewDummyRPCRequest()
-	want := "dummyModule_dummyMethod12"
 	actual := r.GetRequestKey()
-	if actual != want {
-		t.Fatal("invalid request key:", want, actual)
-	}
+	assert.Len(t, actual, 64)
+
+	r.Params = append(make([]any, 0), 2, 1)
+	assert.NotEqual(t, actual, r.GetRequestKey(), "param order must matter")
 }
 
 func TestRPCRequest_GetRequestKeyDifferentTypeParams(t *testing.T) {
 	r := NewDummyRPCRequest()
+	want := r.GetRequestKey()
 	r.Params = append(make([]any, 0), 1, "2")
-	want := "dummyModule_dummyMethod1\"2\""
-	actual := r.GetRequestKey()
-	if actual != want {
-		t.Fatal("invalid request key:", want, actual)
-	}
+	assert.NotEqual(t, want, r.GetRequestKey(), "param types must matter")
 }
 
 func TestRPCRequest_GetRequestKeyEmptyParams(t *testing.T) {
 	r := NewDummyRPCRequest()
 	r.Params = make([]any, 0)
-	want := "dummyModule_dummyMethod"
-	actual := r.GetRequestKey()
-	if actual != want {
-		t.Fatal("invalid request key:", want, actual)
+	want := r.GetRequestKey()
+	r.Params = nil
+	assert.Equal(t, want, r.GetRequestKey())
+}
+
+func TestRPCRequest_GetRequestKeyEquivalentJSON(t *testing.T) {
+	equivalent := []string{
+		`{"id": 1, "jsonrpc": "2.0", "method": "dummyModule_dummyMethod", "params": [1, {"a": 0.5, "b": [true, null]}]}`,
+		`{"id": 2, "jsonrpc": "2.0", "method": "dummyModule_dummyMethod", "params": [1.0, {"b": [true, null], "a": 5e-1}]}`,
+		`{"params":[1e0,{"b":[true,null],"a":0.50}],"method":"dummyModule_dummyMethod","jsonrpc":"2.0","id":"x"}`,
+	}
+	var keys []string
+	for _, data := range equivalent {
+		call, err := ParseCall([]byte(data))
+		assert.NoError(t, err)
+		keys = append(keys, call.GetRequestKey())
+	}
+	assert.Equal(t, keys[0], keys[1])
+	assert.Equal(t, keys[0], keys[2])
+
+	// Requests built in code get the same keys as the parsed ones
+	r := NewDummyRPCRequest()
+	call, err := ParseCall([]byte(`{"id": 1, "jsonrpc": "2.0", "method": "dummyModule_dummyMethod", "params": [1.0, 2]}`))
+	assert.NoError(t, err)
+	assert.Equal(t, r.GetRequestKey(), call.GetRequestKey())
+}
+
+func TestRPCRequest_GetRequestKeyCollisions(t *testing.T) {
+	distinct := []string{
+		`{"id": 1, "jsonrpc": "2.0", "method": "dummyModule_dummyMethod", "params": ["a\"", "b"]}`,
+		`{"id": 1, "jsonrpc": "2.0", "method": "dummyModule_dummyMethod", "params": ["a", "\"b"]}`,
+		`{"id": 1, "jsonrpc": "2.0", "method": "dummyModule_dummyMethod", "params": ["ab"]}`,
+		`{"id": 1, "jsonrpc": "2.0", "method": "dummyModule_dummyMethod", "params": [9007199254740993]}`,
+		`{"id": 1, "jsonrpc": "2.0", "method": "dummyModule_dummyMethod", "params": [9007199254740992]}`,
+		`{"id": 1, "jsonrpc": "2.0", "method": "dummyModule_dummyMethod1", "params": []}`,
+		`{"id": 1, "jsonrpc": "2.0", "method": "dummyModule_dummyMethod", "params": [1]}`,
+	}
+	keys := make(map[string]string)
+	for _, data := range distinct {
+		call, err := ParseCall([]byte(data))
+		assert.NoError(t, err)
+		key := call.GetRequestKey()
+		assert.NotContains(t, keys, key, "collision between %v and %v", data, keys[key])
+		keys[key] = data
+	}
+}
+
+func TestCanonicalJSON(t *testing.T) {
+	actual, err := CanonicalJSON(map[string]any{
+		"b": []any{1.50, -0.0, "x"},
+		"a": map[string]any{"d": nil, "c": false},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, `{"a":{"c":false,"d":null},"b":[1.5,0,"x"]}`, string(actual))
+}
+
+func TestCanonicalJSONNumbers(t *testing.T) {
+	numbers := map[string]string{
+		"0":                       "0",
+		"-0.0e5":                  "0",
+		"1.50":                    "1.5",
+		"-1.5E+0":                 "-1.5",
+		"100":                     "100",
+		"1e2":                     "100",
+		"0.001":                   "0.001",
+		"1e-7":                    "1e-7",
+		"12345e-8":                "0.00012345",
+		"1e20":                    "100000000000000000000",
+		"1e21":                    "1e+21",
+		"9007199254740993":        "9007199254740993",
+		"1.000000000000000000001": "1.000000000000000000001",
+		"1e100000000":             "1e+100000000",
+		"-25e-100000001":          "-2.5e-100000000",
+	}
+	for number, want := range numbers {
+		actual, err := normalizeNumber(json.Number(number))
+		assert.NoError(t, err, number)
+		assert.Equal(t, want, actual, number)
+	}
+
+	for _, number := range []string{"1e1073741825", "1e9999999999999", "1e-99999999999999999999"} {
+		_, err := normalizeNumber(json.Number(number))
+		assert.Error(t, err, number)
 	}
 }
 
@@ -63,9 +141,20 @@ func TestParseCall(t *testing.T) {
 	}
 }
 
+func TestParseCallNotification(t *testing.T) {
+	actual, err := ParseCall([]byte(`{"jsonrpc": "2.0", "method": "dummyModule_dummyMethod", "params": [1,2]}`))
+	assert.NoError(t, err)
+	assert.True(t, actual.IsNotification)
+	assert.Nil(t, actual.ID)
+
+	actual, err = ParseCall([]byte(`{"id": null, "jsonrpc": "2.0", "method": "dummyModule_dummyMethod", "params": [1,2]}`))
+	assert.NoError(t, err)
+	assert.False(t, actual.IsNotification)
+	assert.Nil(t, actual.ID)
+}
+
 func TestParseCallInvalidRequests(t *testing.T) {
 	cases := []string{
-		`{"jsonrpc": "2.0", "method": "dummyModule_dummyMethod", "params": [1,2]}`,
 		`{"id": null, "method": "dummyModule_dummyMethod", "params": [1,2]}`,
 		`{"id": 1, "jsonrpc": "1.0", method": "dummyModule_dummyMethod", "params": [1,2]}`,
 		`{"id": 1, "jsonrpc": "2.0", method": "dummyModuledummyMethod", "params": [1,2]}`,
@@ -75,3 +164,131 @@ func TestParseCallInvalidRequests(t *testing.T) {
 		assert.Errorf(t, err, "no error in parse call when there should be one")
 	}
 }
+
+func TestParseCallInvalidIDs(t *testing.T) {
+	for _, id := range []string{`[1]`, `{"a": 1}`, `true`, `false`} {
+		_, err := ParseCall([]byte(`{"id": ` + id + `, "jsonrpc": "2.0", "method": "dummyModule_dummyMethod", "params": [1,2]}`))
+		assert.ErrorIs(t, err, ErrInvalidID, id)
+		assert.Equal(t, RPCErrorNum(RPCErrorInvalidRequest), GetParseErrorNum(err))
+		assert.Nil(t, ParseRequestID([]byte(`{"id": `+id+`}`)))
+	}
+
+	for _, id := range []string{`"a"`, `1`, `1.5`, `null`} {
+		_, err := ParseCall([]byte(`{"id": ` + id + `, "jsonrpc": "2.0", "method": "dummyModule_dummyMethod", "params": [1,2]}`))
+		assert.NoError(t, err, id)
+	}
+
+	_, err := ParseCall([]byte(`{"id": 1, "jsonrpc": "2.0", "method": `))
+	assert.Equal(t, RPCErrorNum(RPCErrorNotWellFormed), GetParseErrorNum(err))
+}
+
+func TestIsBatch(t *testing.T) {
+	assert.True(t, IsBatch([]byte(`[{"id": 1}]`)))
+	assert.True(t, IsBatch([]byte(" \n\t[]")))
+	assert.False(t, IsBatch([]byte(`{"id": 1}`)))
+	assert.False(t, IsBatch([]byte("")))
+}
+
+func TestIsObject(t *testing.T) {
+	assert.True(t, IsObject([]byte(`{"id": 1}`)))
+	assert.True(t, IsObject([]byte(" \n\t{}")))
+	assert.False(t, IsObject([]byte(`[{"id": 1}]`)))
+	assert.False(t, IsObject([]byte(`"{"`)))
+	assert.False(t, IsObject([]byte("")))
+}
+
+func TestParseBatch(t *testing.T) {
+	calls, err := ParseBatch([]byte(`[{"id": 1}, 2, "3"]`))
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(calls))
+	assert.JSONEq(t, `{"id": 1}`, string(calls[0]))
+
+	calls, err = ParseBatch([]byte(`[]`))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(calls))
+
+	_, err = ParseBatch([]byte(`[{"id": 1}`))
+	assert.Error(t, err)
+}
+
+func TestParseCallNamedParams(t *testing.T) {
+	actual, err := ParseCall([]byte(`{"id": 1, "jsonrpc": "2.0", "method": "dummyModule_dummyMethod", "params": {"a": 1, "b": "x"}}`))
+	assert.NoError(t, err)
+	assert.Nil(t, actual.Params)
+	assert.Equal(t, map[string]any{"a": json.Number("1"), "b": "x"}, actual.NamedParams)
+
+	actual, err = ParseCall([]byte(`{"id": 1, "jsonrpc": "2.0", "method": "dummyModule_dummyMethod"}`))
+	assert.NoError(t, err)
+	assert.Nil(t, actual.Params)
+	assert.Nil(t, actual.NamedParams)
+
+	_, err = ParseCall([]byte(`{"id": 1, "jsonrpc": "2.0", "method": "dummyModule_dummyMethod", "params": 1}`))
+	assert.Error(t, err)
+}
+
+func TestRPCRequest_MarshalJSON(t *testing.T) {
+	cases := []string{
+		`{"params":[1,2],"id":1,"method":"dummyModule_dummyMethod","jsonrpc":"2.0"}`,
+		`{"params":{"a":1},"id":"x","method":"dummyModule_dummyMethod","jsonrpc":"2.0"}`,
+		`{"params":[1],"id":null,"method":"dummyModule_dummyMethod","jsonrpc":"2.0"}`,
+		`{"params":[1],"method":"dummyModule_dummyMethod","jsonrpc":"2.0"}`,
+	}
+	for _, data := range cases {
+		call, err := ParseCall([]byte(data))
+		assert.NoError(t, err)
+		encoded, err := json.Marshal(call)
+		assert.NoError(t, err)
+		assert.JSONEq(t, data, string(encoded))
+	}
+}
+
+func TestRPCRequest_GetPositionalParams(t *testing.T) {
+	schema := &relayutil.RPCMethodSchema{Params: []*relayutil.RPCParamSchema{{Name: "a"}, {Name: "b"}, {Name: "c"}}}
+
+	r := NewDummyRPCRequest()
+	params, err := r.GetPositionalParams(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, r.Params, params)
+
+	r.Params = nil
+	r.NamedParams = map[string]any{"b": 2, "a": 1}
+	params, err = r.GetPositionalParams(schema)
+	assert.NoError(t, err)
+	assert.Equal(t, []any{1, 2}, params)
+
+	r.NamedParams = map[string]any{"c": 3}
+	params, err = r.GetPositionalParams(schema)
+	assert.NoError(t, err)
+	assert.Equal(t, []any{nil, nil, 3}, params)
+
+	r.NamedParams = map[string]any{"d": 4}
+	_, err = r.GetPositionalParams(schema)
+	assert.Error(t, err)
+
+	_, err = r.GetPositionalParams(nil)
+	assert.Error(t, err)
+}
+
+func TestRPCRequest_GetRequestKeyNamedParams(t *testing.T) {
+	first, err := ParseCall([]byte(`{"id": 1, "jsonrpc": "2.0", "method": "dummyModule_dummyMethod", "params": {"a": 1, "b": 2}}`))
+	assert.NoError(t, err)
+	second, err := ParseCall([]byte(`{"id": 2, "jsonrpc": "2.0", "method": "dummyModule_dummyMethod", "params": {"b": 2.0, "a": 1}}`))
+	assert.NoError(t, err)
+	assert.Equal(t, first.GetRequestKey(), second.GetRequestKey())
+	assert.NotEqual(t, first.GetRequestKey(), NewDummyRPCRequest().GetRequestKey())
+}
+
+func TestParseRequestID(t *testing.T) {
+	cases := map[string]any{
+		`{"id": 1, "jsonrpc": "1.0"}`:     json.Number("1"),
+		`{"id": "a", "method": "bad"}`:    "a",
+		`{"id": null, "jsonrpc": "2.0"}`:  nil,
+		`{"id": {"a": 1}}`:                nil,
+		`{"jsonrpc": "2.0"}`:              nil,
+		`{"id": 1, "jsonrpc": "2.0", "me`: nil,
+		`[{"id": 1}]`:                     nil,
+	}
+	for data, id := range cases {
+		assert.Equal(t, id, ParseRequestID([]byte(data)), data)
+	}
+}
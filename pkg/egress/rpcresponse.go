@@ -1,6 +1,8 @@
 package egress
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"strings"
 )
@@ -13,28 +15,106 @@ type RPCResponse struct {
 	ID      any    `json:"id"`
 }
 
+// RPCRawResponse is a JSON-RPC 2.0 response object with the result or the error kept as raw JSON.
+// It allows returning the same response to different requests by replacing the id and jsonrpc fields
+// without decoding and encoding the payload again
+type RPCRawResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      any             `json:"id"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   json.RawMessage `json:"error,omitempty"`
+}
+
+// ParseRawResponse parses a response received from egress or jrpcserver into RPCRawResponse
+func ParseRawResponse(data []byte) (*RPCRawResponse, error) {
+	var response RPCRawResponse
+	if err := json.Unmarshal(data, &response); err != nil {
+		return nil, err
+	}
+	if response.Result == nil && response.Error == nil {
+		return nil, fmt.Errorf("missing result and error fields")
+	}
+	return &response, nil
+}
+
+// IsError checks whether the response is an error response
+func (response *RPCRawResponse) IsError() bool {
+	return response.Error != nil
+}
+
+// GetError decodes the error field of the response
+func (response *RPCRawResponse) GetError() (*RPCError, error) {
+	var rpcErr RPCError
+	if err := json.Unmarshal(response.Error, &rpcErr); err != nil {
+		return nil, err
+	}
+	return &rpcErr, nil
+}
+
+// WithRequest returns a copy of the response addressed to the given request. The payload is shared
+// between the copies
+func (response *RPCRawResponse) WithRequest(request *RPCRequest) *RPCRawResponse {
+	return &RPCRawResponse{
+		JSONRPC: request.JSONRPC,
+		ID:      request.ID,
+		Result:  response.Result,
+		Error:   response.Error,
+	}
+}
+
+// Encode serializes the response. Only the id and jsonrpc fields are encoded, the result or the error
+// are written as they are
+func (response *RPCRawResponse) Encode() ([]byte, error) {
+	jsonrpc, err := json.Marshal(response.JSONRPC)
+	if err != nil {
+		return nil, err
+	}
+	id, err := json.Marshal(response.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(len(jsonrpc) + len(id) + len(response.Result) + len(response.Error) + 32)
+	buf.WriteString(`{"jsonrpc":`)
+	buf.Write(jsonrpc)
+	buf.WriteString(`,"id":`)
+	buf.Write(id)
+	if response.IsError() {
+		buf.WriteString(`,"error":`)
+		buf.Write(response.Error)
+	} else {
+		buf.WriteString(`,"result":`)
+		buf.Write(response.Result)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
 // RPCErrorNum is an alias to help distinguish between RPC spec error codes
 type RPCErrorNum int
 
 // TODO: Add more codes or use them from elsewhere (geth's rpc codes are not exported)
 const (
-	RPCErrorNotWellFormed    RPCErrorNum = -32700
-	RPCErrorInvalidRequest               = -32600
-	RPCErrorMethodNotFound               = -32601
-	RPCErrorInvalidParams                = -32602
-	RPCErrorInternalError                = -32603
-	RPCErrorModuleNotEnabled             = 101
-)
-
-const (
-	RPCPrefixInvalidArgument string = "invalid argument"
+	RPCErrorNotWellFormed  RPCErrorNum = -32700
+	RPCErrorInvalidRequest             = -32600
+	RPCErrorMethodNotFound             = -32601
+	RPCErrorInvalidParams              = -32602
+	RPCErrorInternalError              = -32603
+	// Range of implementation-defined server errors. go-ethereum uses RPCErrorServerError for plain Go errors
+	// returned by RPC methods
+	RPCErrorServerError      = -32000
+	RPCErrorServerErrorMin   = -32099
+	RPCErrorModuleNotEnabled = 101
+	RPCErrorMethodNotEnabled = 102
+	// Authentication and authorization errors of ingress
+	RPCErrorUnauthorized = 103
+	RPCErrorForbidden    = 104
+	// Rate limiting errors of ingress
+	RPCErrorRateLimited   = 105
+	RPCErrorQuotaExceeded = 106
 )
 
-// RPCErrorMap is used for checking responses from jrpcserver/geth JSONRPC server
-var RPCErrorMap = map[string]RPCErrorNum{
-	RPCPrefixInvalidArgument: RPCErrorInvalidParams,
-}
-
 // Used for responding to ingress server
 var errorResponseMap = map[RPCErrorNum]string{
 	RPCErrorNotWellFormed:    "not well formed",
@@ -42,13 +122,36 @@ var errorResponseMap = map[RPCErrorNum]string{
 	RPCErrorMethodNotFound:   "method not found",
 	RPCErrorInvalidParams:    "invalid params",
 	RPCErrorInternalError:    "internal error",
+	RPCErrorServerError:      "server error",
 	RPCErrorModuleNotEnabled: "module not enabled",
+	RPCErrorMethodNotEnabled: "method not enabled",
+	RPCErrorUnauthorized:     "unauthorized",
+	RPCErrorForbidden:        "forbidden",
+	RPCErrorRateLimited:      "rate limit exceeded",
+	RPCErrorQuotaExceeded:    "quota exceeded",
 }
 
 // RPCError is a JSON-RPC 2.0 error response field
 type RPCError struct {
 	Code    RPCErrorNum `json:"code"`
 	Message string      `json:"message"`
+	Data    any         `json:"data,omitempty"`
+}
+
+// IsInternalError checks whether the error code is the internal error code or a server error code
+func (num RPCErrorNum) IsInternalError() bool {
+	return num == RPCErrorInternalError || (num >= RPCErrorServerErrorMin && num <= RPCErrorServerError)
+}
+
+// GetMessage returns the standard message for the error code
+func (num RPCErrorNum) GetMessage() string {
+	if message, ok := errorResponseMap[num]; ok {
+		return message
+	}
+	if num.IsInternalError() {
+		return errorResponseMap[RPCErrorServerError]
+	}
+	return fmt.Sprintf("error %d", num)
 }
 
 // RPCErrorResponse is a JSON-RPC 2.0 response object that is returned instead of RPCResponse
@@ -68,8 +171,9 @@ func CreateResponse(result any, request *RPCRequest) *RPCResponse {
 	}
 }
 
-// CreateErrorResponse serializes an error into a RPCErrorResponse
-func CreateErrorResponse(num RPCErrorNum, info ...any) *RPCErrorResponse {
+// CreateErrorResponse serializes an error into a RPCErrorResponse addressed to the request with the given id.
+// The id is nil if the request could not be parsed
+func CreateErrorResponse(id any, num RPCErrorNum, info ...any) *RPCErrorResponse {
 	var errMsg strings.Builder
 	// We can pass any type of info, but usually the type is string, therefore spaces are not added
 	// by default - see godoc for Sprint/Sprintf
@@ -80,7 +184,7 @@ func CreateErrorResponse(num RPCErrorNum, info ...any) *RPCErrorResponse {
 
 	return &RPCErrorResponse{
 		JSONRPC: "2.0",
-		ID:      nil,
-		Error:   &RPCError{num, errMsg.String()},
+		ID:      id,
+		Error:   &RPCError{Code: num, Message: errMsg.String()},
 	}
 }
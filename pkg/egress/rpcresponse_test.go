@@ -24,7 +24,7 @@ func TestCreateResponse(t *testing.T) {
 
 func TestCreateErrorResponse(t *testing.T) {
 	for errNum, errMsg := range errorResponseMap {
-		resp := CreateErrorResponse(errNum)
+		resp := CreateErrorResponse(nil, errNum)
 		assert.Equal(t, resp.JSONRPC, "2.0")
 		assert.Nil(t, resp.ID)
 		assert.Equal(t, resp.Error.Code, errNum)
@@ -34,9 +34,60 @@ func TestCreateErrorResponse(t *testing.T) {
 
 func TestCreateErrorResponseWithCustomInfo(t *testing.T) {
 	info := append(make([]any, 0), "err1", "err2")
-	resp := CreateErrorResponse(RPCErrorInvalidParams, info...)
+	resp := CreateErrorResponse(1, RPCErrorInvalidParams, info...)
 	assert.Equal(t, resp.JSONRPC, "2.0")
-	assert.Nil(t, resp.ID)
+	assert.Equal(t, 1, resp.ID)
 	assert.Equal(t, int(resp.Error.Code), RPCErrorInvalidParams)
 	assert.Equal(t, resp.Error.Message, fmt.Sprintf("%v %v %v", errorResponseMap[RPCErrorInvalidParams], info[0], info[1]))
 }
+
+func TestParseRawResponse(t *testing.T) {
+	resp, err := ParseRawResponse([]byte(`{"jsonrpc": "2.0", "id": 1, "result": {"a": [1, 2]}}`))
+	assert.NoError(t, err)
+	assert.False(t, resp.IsError())
+	assert.JSONEq(t, `{"a": [1, 2]}`, string(resp.Result))
+
+	resp, err = ParseRawResponse([]byte(`{"jsonrpc": "2.0", "id": 1, "result": null}`))
+	assert.NoError(t, err)
+	assert.False(t, resp.IsError())
+	assert.Equal(t, "null", string(resp.Result))
+
+	resp, err = ParseRawResponse([]byte(`{"jsonrpc": "2.0", "id": 1, "error": {"code": -32602, "message": "invalid params"}}`))
+	assert.NoError(t, err)
+	assert.True(t, resp.IsError())
+	rpcErr, err := resp.GetError()
+	assert.NoError(t, err)
+	assert.Equal(t, RPCErrorNum(RPCErrorInvalidParams), rpcErr.Code)
+
+	_, err = ParseRawResponse([]byte(`{"jsonrpc": "2.0", "id": 1}`))
+	assert.Error(t, err)
+}
+
+func TestRPCRawResponse_WithRequest(t *testing.T) {
+	resp, err := ParseRawResponse([]byte(`{"jsonrpc": "2.0", "id": 1, "result": "res"}`))
+	assert.NoError(t, err)
+
+	req := NewDummyRPCRequest()
+	req.ID = "callerID"
+	encoded, err := resp.WithRequest(req).Encode()
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"jsonrpc": "2.0", "id": "callerID", "result": "res"}`, string(encoded))
+
+	resp, err = ParseRawResponse([]byte(`{"jsonrpc": "2.0", "id": 1, "error": {"code": 101, "message": "err"}}`))
+	assert.NoError(t, err)
+	encoded, err = resp.WithRequest(req).Encode()
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"jsonrpc": "2.0", "id": "callerID", "error": {"code": 101, "message": "err"}}`, string(encoded))
+}
+
+func TestRPCErrorNum_IsInternalError(t *testing.T) {
+	assert.True(t, RPCErrorNum(RPCErrorInternalError).IsInternalError())
+	assert.True(t, RPCErrorNum(RPCErrorServerError).IsInternalError())
+	assert.True(t, RPCErrorNum(-32050).IsInternalError())
+	assert.False(t, RPCErrorNum(RPCErrorInvalidParams).IsInternalError())
+	assert.False(t, RPCErrorNum(3).IsInternalError())
+
+	assert.Equal(t, "invalid params", RPCErrorNum(RPCErrorInvalidParams).GetMessage())
+	assert.Equal(t, "server error", RPCErrorNum(-32050).GetMessage())
+	assert.Equal(t, "error 3", RPCErrorNum(3).GetMessage())
+}
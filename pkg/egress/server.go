@@ -1,13 +1,17 @@
 package egress
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"github.com/ethereum/go-ethereum/rpc"
 	"github.com/nats-io/nats.go"
 	"github.com/parkanaur/rpc-relay/pkg/relayutil"
 	log "github.com/sirupsen/logrus"
-	"strings"
+	"io"
+	"runtime/debug"
 	"sync"
+	"time"
 )
 
 // Server is a structure for the egress server holding the NATS listener and a client for JSON-RPC calls
@@ -43,77 +47,142 @@ type MsgContext struct {
 	config    *relayutil.Config
 }
 
-// logAndSendError logs the error to stderr and returns an RPCErrorResponse to the ingress server
-func logAndSendError(errNum RPCErrorNum, msgCtx *MsgContext, info ...any) {
+// isNotification checks if the NATS message carries a JSON-RPC notification. Ingress publishes
+// notifications without a reply subject since no response is expected
+func (msgCtx *MsgContext) isNotification() bool {
+	return msgCtx.msg.Reply == ""
+}
+
+// logAndCreateError logs the error to stderr and returns a relay error reply for the ingress server
+// addressed to the request with the given id
+func logAndCreateError(errorClass RelayErrorClass, id any, errNum RPCErrorNum, info ...any) *EgressReply {
 	log.Errorln(info...)
 	// Info is prevented from being returned to user on purpose to avoid disclosing sensitive
 	// error info
-	resp, err := json.Marshal(CreateErrorResponse(errNum))
-	if err != nil {
-		log.Errorln("Error while marshalling error:", err)
+	return NewEgressReply(ReplyStatusRelayError, errorClass, CreateErrorResponse(id, errNum))
+}
+
+// createBackendErrorReply converts an error of the RPC call into an error reply. Errors returned
+// by jrpcserver keep their code, message and data, except for internal errors which are redacted
+// according to the redaction policy. Other errors, such as transport errors, become internal errors
+func createBackendErrorReply(id any, err error, redaction string) *EgressReply {
+	var rpcErr rpc.Error
+	if !errors.As(err, &rpcErr) {
+		return NewEgressReply(
+			ReplyStatusRelayError, RelayErrorBackendUnavailable, CreateErrorResponse(id, RPCErrorInternalError))
+	}
+
+	resp := CreateErrorResponse(id, RPCErrorNum(rpcErr.ErrorCode()))
+	resp.Error.Message = rpcErr.Error()
+	var dataErr rpc.DataError
+	if errors.As(err, &dataErr) {
+		resp.Error.Data = dataErr.ErrorData()
+	}
+
+	if resp.Error.Code.IsInternalError() {
+		switch redaction {
+		case relayutil.ErrorRedactionNone:
+		case relayutil.ErrorRedactionData:
+			resp.Error.Data = nil
+		default:
+			resp.Error.Message = resp.Error.Code.GetMessage()
+			resp.Error.Data = nil
+		}
+	}
+	return NewEgressReply(ReplyStatusBackendError, "", resp)
+}
+
+// handleRPCRequest handles incoming NATS messages, sends RPC requests and replies to NATS messages.
+// Every NATS message except notifications gets exactly one reply, even if handling it panics
+func handleRPCRequest(msgCtx *MsgContext) {
+	replied := false
+	defer func() {
+		if r := recover(); r != nil {
+			log.Errorln("Panic during RPC request handling", r, string(debug.Stack()))
+			if replied || msgCtx.isNotification() {
+				return
+			}
+			// Ingress would otherwise wait for the reply until it times out
+			encodedReply, _ := json.Marshal(NewEgressReply(ReplyStatusRelayError, RelayErrorInternal,
+				CreateErrorResponse(ParseRequestID(msgCtx.msg.Data), RPCErrorInternalError)))
+			if err := msgCtx.msg.Respond(encodedReply); err != nil {
+				log.Errorln("Error during NATS response", err)
+			}
+		}
+	}()
+
+	reply := callRPC(msgCtx)
+	if msgCtx.isNotification() {
 		return
 	}
 
-	err = msgCtx.msg.Respond(resp)
+	encodedReply, err := json.Marshal(reply)
 	if err != nil {
+		log.Errorln("Error during JSON reply encoding", err)
+		encodedReply, _ = json.Marshal(
+			&EgressReply{EgressReplyVersion, ReplyStatusRelayError, RelayErrorInternal, internalErrorResponse, 0})
+	}
+
+	// NATS reply
+	replied = true
+	if err := msgCtx.msg.Respond(encodedReply); err != nil {
 		log.Errorln("Error during NATS response", err)
-		return
 	}
 }
 
-// handleRPCRequest handles incoming NATS messages, sends RPC requests and replies to NATS messages
-func handleRPCRequest(msgCtx *MsgContext) {
+// callRPC makes the RPC call for the incoming NATS message and returns the reply for ingress.
+// The return value is nil for notifications
+func callRPC(msgCtx *MsgContext) *EgressReply {
 	rpcRequest, err := ParseCall(msgCtx.msg.Data)
 	if err != nil {
-		logAndSendError(RPCErrorNotWellFormed, msgCtx, string(msgCtx.msg.Data), err)
-		return
+		return logAndCreateError(RelayErrorRejected, ParseRequestID(msgCtx.msg.Data),
+			GetParseErrorNum(err), string(msgCtx.msg.Data), err)
 	}
 	// Checking if method is available for calling
-	if _, ok := msgCtx.config.JRPCServer.EnabledRPCModules[rpcRequest.ModuleName]; !ok {
-		logAndSendError(RPCErrorModuleNotEnabled, msgCtx, rpcRequest.ModuleName)
-		return
+	if !msgCtx.config.JRPCServer.IsRPCModuleEnabled(rpcRequest.ModuleName) {
+		return logAndCreateError(RelayErrorRejected, rpcRequest.ID, RPCErrorModuleNotEnabled, rpcRequest.ModuleName)
 	}
-	// TODO: implement check for whether the method is enabled (via EnabledRPCMethods dict values for
-	// given module). Possibly requires rewriting the method list to be a map for
-	// faster checks.
-
-	// Actual rpc call
-	var result any
-	err = msgCtx.rpcClient.Call(&result, rpcRequest.GetFullMethodName(), rpcRequest.Params...)
+	if !msgCtx.config.JRPCServer.IsRPCMethodEnabled(rpcRequest.ModuleName, rpcRequest.MethodName) {
+		return logAndCreateError(RelayErrorRejected, rpcRequest.ID, RPCErrorMethodNotEnabled,
+			rpcRequest.GetFullMethodName())
+	}
+	params, err := rpcRequest.GetPositionalParams(
+		msgCtx.config.JRPCServer.RPCMethodSchemas[rpcRequest.GetFullMethodName()])
 	if err != nil {
-		errStr := err.Error()
-		var rpcErrNum RPCErrorNum = RPCErrorInternalError
-
-		// Filter out errors caused by user's incorrect requests
-		for errorPrefix, errorNum := range RPCErrorMap {
-			if strings.HasPrefix(errStr, errorPrefix) {
-				rpcErrNum = errorNum
-			}
-		}
-		logAndSendError(rpcErrNum, msgCtx, err)
-		return
+		return logAndCreateError(RelayErrorRejected, rpcRequest.ID, RPCErrorInvalidParams, err)
 	}
 
-	// Encoding and sending the result
-	if result != nil {
-		resp := CreateResponse(result, rpcRequest)
-		encodedResp, err := json.Marshal(&resp)
-		if err != nil {
-			logAndSendError(RPCErrorInternalError, msgCtx, "Error during JSON response encoding", err)
-			return
+	if msgCtx.isNotification() {
+		err = msgCtx.rpcClient.Notify(context.Background(), rpcRequest.GetFullMethodName(), params...)
+		// go-ethereum's HTTP client tries to decode a response even for notifications, while the server
+		// replies to them with an empty body
+		if err != nil && err != io.EOF {
+			log.Errorln("Error during RPC notification", err)
 		}
+		return nil
+	}
 
-		// NATS reply
-		err = msgCtx.msg.Respond(encodedResp)
-		if err != nil {
-			logAndSendError(RPCErrorInternalError, msgCtx, "Error during NATS response", err)
-			return
-		}
+	// Actual rpc call
+	var result any
+	callStart := time.Now()
+	err = msgCtx.rpcClient.Call(&result, rpcRequest.GetFullMethodName(), params...)
+	var reply *EgressReply
+	if err != nil {
+		log.Errorln("Error during RPC call", err)
+		reply = createBackendErrorReply(rpcRequest.ID, err, msgCtx.config.Egress.InternalErrorRedaction)
+	} else {
+		// Methods without a return value and methods returning null produce a response with a null result
+		reply = NewEgressReply(ReplyStatusOK, "", CreateResponse(result, rpcRequest))
 	}
+	reply.BackendDuration = time.Since(callStart)
+	return reply
 }
 
 // NewServer creates a new egress server from the config
 func NewServer(config *relayutil.Config) (*Server, error) {
+	// The config may have been built without relayutil.NewConfig
+	config.JRPCServer.BuildRPCMethodSets()
+
 	wg := sync.WaitGroup{}
 	wg.Add(1)
 	// Init NATS
@@ -134,7 +203,11 @@ func NewServer(config *relayutil.Config) (*Server, error) {
 		config.NATS.SubjectName,
 		config.NATS.QueueName,
 		func(msg *nats.Msg) {
-			log.Infoln("Incoming RPC request:", string(msg.Data))
+			if caller := GetCaller(msg); caller != "" {
+				log.Infoln("Incoming RPC request from", caller+":", string(msg.Data))
+			} else {
+				log.Infoln("Incoming RPC request:", string(msg.Data))
+			}
 			go handleRPCRequest(&MsgContext{msg, rpcClient, config})
 		})
 	if err != nil {
@@ -0,0 +1,101 @@
+package ingress
+
+import (
+	"crypto/sha256"
+	"errors"
+	"github.com/parkanaur/rpc-relay/pkg/relayutil"
+	"net/http"
+	"strings"
+)
+
+var (
+	errMissingCredentials = errors.New("missing API key or token")
+	errInvalidAPIKey      = errors.New("invalid API key")
+)
+
+// rpcMethodPermission grants RPC methods to a caller
+type rpcMethodPermission interface {
+	IsRPCMethodAllowed(moduleName, methodName string) bool
+}
+
+// rpcCaller is a user authenticated with an API key or a JWT
+type rpcCaller struct {
+	// Name of the caller, passed to egress
+	Name string
+	// The caller may call a method if any of the permissions allows it
+	permissions []rpcMethodPermission
+}
+
+// isRPCMethodAllowed checks whether the caller may call the method
+func (caller *rpcCaller) isRPCMethodAllowed(moduleName, methodName string) bool {
+	for _, permission := range caller.permissions {
+		if permission.IsRPCMethodAllowed(moduleName, methodName) {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticator finds the callers of HTTP requests. API keys are looked up by their SHA-256 hashes,
+// so that the lookup time does not depend on how much of a key matches
+type authenticator struct {
+	// Header carrying the API key
+	header string
+	keys   map[[sha256.Size]byte]*relayutil.APIKey
+	// Nil if JWTs are not accepted
+	jwt *jwtValidator
+}
+
+// newAuthenticator loads the API keys and the JWKS from the config
+func newAuthenticator(config *relayutil.AuthConfig) (*authenticator, error) {
+	keys, err := config.LoadAPIKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	auth := &authenticator{header: config.APIKeyHeader, keys: make(map[[sha256.Size]byte]*relayutil.APIKey, len(keys))}
+	if auth.header == "" {
+		auth.header = relayutil.DefaultAPIKeyHeader
+	}
+	for _, key := range keys {
+		auth.keys[sha256.Sum256([]byte(key.Key))] = key
+	}
+	if config.JWT != nil {
+		if auth.jwt, err = newJWTValidator(config.JWT); err != nil {
+			return nil, err
+		}
+	}
+	return auth, nil
+}
+
+// authenticate returns the caller of the request. The API key is taken from the API key header or from
+// the Authorization header as a bearer token. Bearer tokens which look like JWTs are validated as JWTs
+// if they are accepted
+func (auth *authenticator) authenticate(req *http.Request) (*rpcCaller, error) {
+	token := req.Header.Get(auth.header)
+	isBearer := false
+	if token == "" {
+		scheme, value, ok := strings.Cut(req.Header.Get("Authorization"), " ")
+		if ok && strings.EqualFold(scheme, "Bearer") {
+			token = strings.TrimSpace(value)
+			isBearer = true
+		}
+	}
+	if token == "" {
+		return nil, errMissingCredentials
+	}
+
+	if isBearer && auth.jwt != nil && isJWT(token) {
+		claims, err := auth.jwt.validate(token)
+		if err != nil {
+			return nil, err
+		}
+		return auth.jwt.newCaller(claims), nil
+	}
+
+	apiKey, ok := auth.keys[sha256.Sum256([]byte(token))]
+	if !ok {
+		return nil, errInvalidAPIKey
+	}
+	return &rpcCaller{Name: apiKey.Name, permissions: []rpcMethodPermission{apiKey}}, nil
+}
@@ -0,0 +1,100 @@
+package ingress
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/nats-io/nats.go"
+	"github.com/parkanaur/rpc-relay/pkg/egress"
+	"github.com/parkanaur/rpc-relay/pkg/relayutil"
+	"time"
+)
+
+// Cache backends available in ingress.cacheBackend config key
+const (
+	CacheBackendMemory string = "memory"
+	CacheBackendRedis  string = "redis"
+	CacheBackendNATS   string = "nats"
+)
+
+// Cache is a storage for cached requests used by the ingress server
+type Cache interface {
+	// Add adds a new RPCRequest and its response to the cache
+	Add(request *egress.RPCRequest, response *egress.RPCRawResponse)
+	// GetRequestByKey searches for and returns the cached request by its key
+	GetRequestByKey(requestKey string) (*CachedRequest, bool)
+	// RemoveByKey removes a request from the cache by its key
+	RemoveByKey(requestKey string) error
+	// Start enables the expiration of cached requests
+	Start()
+	// Stop disables the expiration of cached requests and releases the resources held by the cache
+	Stop()
+}
+
+// NewCache creates a cache using the backend from the config. NATS connection is used by the "nats" backend
+func NewCache(config *relayutil.Config, nc *nats.Conn) (Cache, error) {
+	switch config.Ingress.CacheBackend {
+	case "", CacheBackendMemory:
+		return NewRequestCache(config), nil
+	case CacheBackendRedis:
+		return NewRedisCache(config)
+	case CacheBackendNATS:
+		return NewNATSCache(config, nc)
+	default:
+		return nil, fmt.Errorf("unknown cache backend: %v", config.Ingress.CacheBackend)
+	}
+}
+
+// getExpirationThreshold returns the time after which the request expires according to its cache policy
+func getExpirationThreshold(config *relayutil.Config, request *egress.RPCRequest) time.Duration {
+	return relayutil.GetDurationInSeconds(
+		config.Ingress.GetCachePolicy(request.ModuleName, request.MethodName).ExpireCachedRequestThreshold)
+}
+
+// storedCachedRequest is the representation of CachedRequest used by the external cache backends
+type storedCachedRequest struct {
+	CTime      time.Time
+	ExpiryTime time.Time
+	// RPCRequest serialized into bytes, parsed with ParseCall when the request is retrieved
+	Request  json.RawMessage
+	Response *egress.RPCRawResponse
+}
+
+// encodeCachedRequest serializes the request and its response for storing in an external cache backend.
+// The response id is not stored since it belongs to the request which populated the cache
+func encodeCachedRequest(
+	request *egress.RPCRequest, response *egress.RPCRawResponse, expireAfter time.Duration) ([]byte, error) {
+	encodedRequest, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+
+	cTime := time.Now()
+	return json.Marshal(&storedCachedRequest{
+		CTime:      cTime,
+		ExpiryTime: cTime.Add(expireAfter),
+		Request:    encodedRequest,
+		Response:   &egress.RPCRawResponse{Result: response.Result, Error: response.Error},
+	})
+}
+
+// decodeCachedRequest parses the cached request stored in an external cache backend
+func decodeCachedRequest(data []byte) (*CachedRequest, error) {
+	var storedRequest storedCachedRequest
+	if err := json.Unmarshal(data, &storedRequest); err != nil {
+		return nil, err
+	}
+	if storedRequest.Response == nil {
+		return nil, fmt.Errorf("missing cached response")
+	}
+	request, err := egress.ParseCall(storedRequest.Request)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CachedRequest{
+		CTime:      storedRequest.CTime,
+		ExpiryTime: storedRequest.ExpiryTime,
+		Request:    request,
+		Response:   storedRequest.Response,
+	}, nil
+}
@@ -0,0 +1,82 @@
+package ingress
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Values of the X-Cache response header
+const (
+	CacheStatusHit   string = "HIT"
+	CacheStatusMiss  string = "MISS"
+	CacheStatusStale string = "STALE"
+)
+
+// CacheDirectives holds the Cache-Control request header directives honored by ingress
+type CacheDirectives struct {
+	// The cached response must not be returned, but the new response may be cached
+	NoCache bool
+	// The response must neither be taken from the cache nor stored in it
+	NoStore bool
+	// Maximum acceptable age of the cached response. Only used if HasMaxAge is set
+	MaxAge    time.Duration
+	HasMaxAge bool
+}
+
+// ParseCacheDirectives parses the Cache-Control request header. Unknown or malformed directives are ignored
+func ParseCacheDirectives(header http.Header) *CacheDirectives {
+	var directives CacheDirectives
+	for _, value := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			name, arg, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			switch strings.ToLower(name) {
+			case "no-cache":
+				directives.NoCache = true
+			case "no-store":
+				directives.NoStore = true
+			case "max-age":
+				seconds, err := strconv.Atoi(strings.Trim(arg, `"`))
+				if err == nil && seconds >= 0 {
+					directives.MaxAge = time.Duration(seconds) * time.Second
+					directives.HasMaxAge = true
+				}
+			}
+		}
+	}
+	return &directives
+}
+
+// cacheInfo describes how the cache was used during a call. It is returned to the user as response headers
+type cacheInfo struct {
+	// X-Cache header value
+	Status string
+	// Age of the returned response
+	Age time.Duration
+	// Time left until the returned response has to be refreshed
+	MaxAge time.Duration
+	// Set if the response is not cacheable
+	NoStore bool
+}
+
+// newCacheInfo creates cacheInfo for a response of the given age which has to be refreshed after refreshAfter
+func newCacheInfo(status string, age time.Duration, refreshAfter time.Duration) *cacheInfo {
+	maxAge := refreshAfter - age
+	if maxAge < 0 {
+		maxAge = 0
+	}
+	return &cacheInfo{Status: status, Age: age, MaxAge: maxAge}
+}
+
+// setHeaders sets the Age, Cache-Control and X-Cache response headers
+func (info *cacheInfo) setHeaders(header http.Header) {
+	header.Set("X-Cache", info.Status)
+	if info.NoStore {
+		header.Set("Cache-Control", "no-store")
+		return
+	}
+	header.Set("Age", strconv.Itoa(int(info.Age.Seconds())))
+	header.Set("Cache-Control", fmt.Sprintf("max-age=%d", int(info.MaxAge.Seconds())))
+}
@@ -0,0 +1,86 @@
+package ingress
+
+import (
+	"errors"
+	"github.com/parkanaur/rpc-relay/pkg/egress"
+	log "github.com/sirupsen/logrus"
+	"runtime/debug"
+	"sync"
+)
+
+// errCallPanicked is the result of a call whose fetch panicked
+var errCallPanicked = errors.New("panic during egress call")
+
+// pendingCall is an egress call in flight. Its result is shared between all requests with the same key
+type pendingCall struct {
+	wg       sync.WaitGroup
+	response *egress.RPCRawResponse
+	err      error
+}
+
+// callGroup deduplicates concurrent egress calls for identical requests: only one call per request key
+// is in flight at any moment and all the waiters get its result
+type callGroup struct {
+	sync.Mutex
+	calls map[string]*pendingCall
+}
+
+// newCallGroup returns an empty call group
+func newCallGroup() *callGroup {
+	return &callGroup{calls: make(map[string]*pendingCall)}
+}
+
+// begin returns the call in flight for the given request key. If there is none, a new call is registered
+// and isNew is set, in which case the caller has to run it
+func (group *callGroup) begin(requestKey string) (call *pendingCall, isNew bool) {
+	group.Lock()
+	defer group.Unlock()
+
+	if call, ok := group.calls[requestKey]; ok {
+		return call, false
+	}
+	call = &pendingCall{}
+	call.wg.Add(1)
+	group.calls[requestKey] = call
+	return call, true
+}
+
+// finish runs fetch for the registered call and wakes up the waiters. If fetch panics, the call fails
+// with errCallPanicked, so that the waiters are not stuck and the key is free for the next calls
+func (group *callGroup) finish(requestKey string, call *pendingCall, fetch func() (*egress.RPCRawResponse, error)) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Errorln("Panic during egress call", requestKey, r, string(debug.Stack()))
+			call.response, call.err = nil, errCallPanicked
+		}
+
+		group.Lock()
+		delete(group.calls, requestKey)
+		group.Unlock()
+		call.wg.Done()
+	}()
+
+	call.response, call.err = fetch()
+}
+
+// Do runs fetch for the given request key unless a call for the same key is already in flight, in which case
+// it waits for that call to finish and returns its result. shared is true if the result was obtained by
+// another caller
+func (group *callGroup) Do(
+	requestKey string, fetch func() (*egress.RPCRawResponse, error)) (response *egress.RPCRawResponse, shared bool, err error) {
+	call, isNew := group.begin(requestKey)
+	if isNew {
+		group.finish(requestKey, call, fetch)
+	} else {
+		call.wg.Wait()
+	}
+	return call.response, !isNew, call.err
+}
+
+// Go runs fetch in the background unless a call for the same key is already in flight. A panic in fetch
+// only fails the call, as in Do, instead of taking the whole process down
+func (group *callGroup) Go(requestKey string, fetch func() (*egress.RPCRawResponse, error)) {
+	if call, isNew := group.begin(requestKey); isNew {
+		go group.finish(requestKey, call, fetch)
+	}
+}
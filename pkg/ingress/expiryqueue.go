@@ -0,0 +1,48 @@
+package ingress
+
+import (
+	"container/heap"
+	"time"
+)
+
+// expiryQueue is a min-heap of cached requests ordered by their expiry time. It implements heap.Interface,
+// so it has to be modified with the container/heap functions only
+type expiryQueue []*CachedRequest
+
+func (queue expiryQueue) Len() int {
+	return len(queue)
+}
+
+func (queue expiryQueue) Less(i, j int) bool {
+	return queue[i].ExpiryTime.Before(queue[j].ExpiryTime)
+}
+
+func (queue expiryQueue) Swap(i, j int) {
+	queue[i], queue[j] = queue[j], queue[i]
+	queue[i].expiryIndex = i
+	queue[j].expiryIndex = j
+}
+
+func (queue *expiryQueue) Push(x any) {
+	request := x.(*CachedRequest)
+	request.expiryIndex = len(*queue)
+	*queue = append(*queue, request)
+}
+
+func (queue *expiryQueue) Pop() any {
+	old := *queue
+	n := len(old)
+	request := old[n-1]
+	old[n-1] = nil
+	request.expiryIndex = -1
+	*queue = old[:n-1]
+	return request
+}
+
+// popExpired removes and returns the request which expired before the deadline, if there is one
+func (queue *expiryQueue) popExpired(deadline time.Time) (*CachedRequest, bool) {
+	if queue.Len() == 0 || !(*queue)[0].ExpiryTime.Before(deadline) {
+		return nil, false
+	}
+	return heap.Pop(queue).(*CachedRequest), true
+}
@@ -0,0 +1,99 @@
+package ingress
+
+import (
+	"errors"
+	"github.com/nats-io/nats.go"
+	"github.com/parkanaur/rpc-relay/pkg/egress"
+	"github.com/parkanaur/rpc-relay/pkg/relayutil"
+	"net/http"
+)
+
+// getReplyHTTPStatus maps an egress reply to the HTTP status of a single-request response:
+//   - 200 if jrpcserver returned a result
+//   - 400 if the request was rejected by egress (not well formed, the method is not enabled, invalid params)
+//     or jrpcserver returned an error other than the internal error
+//   - 500 if egress failed to handle the request
+//   - 502 if jrpcserver could not be reached or returned the internal error
+func getReplyHTTPStatus(reply *egress.EgressReply) int {
+	switch reply.Status {
+	case egress.ReplyStatusOK:
+		return http.StatusOK
+	case egress.ReplyStatusBackendError:
+		if reply.IsFailure() {
+			return http.StatusBadGateway
+		}
+		return http.StatusBadRequest
+	}
+	switch reply.ErrorClass {
+	case egress.RelayErrorRejected:
+		return http.StatusBadRequest
+	case egress.RelayErrorBackendUnavailable:
+		return http.StatusBadGateway
+	}
+	return http.StatusInternalServerError
+}
+
+// getFailureHTTPStatus maps an error of the egress call to the HTTP status of a single-request response:
+//   - the status of the egress reply (see getReplyHTTPStatus) if egress replied with a failure
+//   - 503 if no egress server is listening
+//   - 504 if egress did not reply in time
+//   - 500 otherwise, including malformed egress replies
+func getFailureHTTPStatus(err error) int {
+	var egressErr *egressError
+	switch {
+	case errors.As(err, &egressErr):
+		return getReplyHTTPStatus(egressErr.Reply)
+	case errors.Is(err, nats.ErrNoResponders):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, nats.ErrTimeout):
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusInternalServerError
+}
+
+// getResultHTTPStatus returns the HTTP status of a single-request response. In the "jsonrpc" status mode
+// every JSON-RPC response gets 200, except for rate-limited calls which keep 429 so that clients and
+// proxies back off. Otherwise the status table of the config takes precedence over the default mapping
+// for error responses
+func (server *Server) getResultHTTPStatus(result *callResult) int {
+	ingressConfig := server.config.Ingress
+	if ingressConfig.HTTPStatusMode == relayutil.HTTPStatusModeJSONRPC {
+		if result.StatusCode == http.StatusTooManyRequests {
+			return result.StatusCode
+		}
+		return http.StatusOK
+	}
+	if result.IsError {
+		if status, ok := ingressConfig.HTTPStatusCodes[int(result.ErrorCode)]; ok {
+			return status
+		}
+	}
+	return result.StatusCode
+}
+
+// writeResult writes the result of a single request to the user
+func (server *Server) writeResult(w http.ResponseWriter, result *callResult) {
+	if result.Cache != nil {
+		result.Cache.setHeaders(w.Header())
+	}
+	if result.RateLimit != nil {
+		result.RateLimit.setHeaders(w.Header())
+	}
+	// Notifications
+	if result.Response == nil {
+		w.WriteHeader(result.StatusCode)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(server.getResultHTTPStatus(result))
+	w.Write(result.Response)
+}
+
+// writeHTTPError writes an error response for a failure at the HTTP level, e.g. a wrong HTTP method.
+// Such failures are not JSON-RPC errors, so the status does not depend on the status mode
+func writeHTTPError(w http.ResponseWriter, statusCode int, errNum egress.RPCErrorNum, info ...any) {
+	result := newErrorResult(statusCode, nil, errNum, info...)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(result.StatusCode)
+	w.Write(result.Response)
+}
@@ -0,0 +1,254 @@
+package ingress
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/parkanaur/rpc-relay/pkg/relayutil"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// minJWKSRefreshInterval limits how often the JWKS is fetched again because of tokens signed with
+// unknown keys
+const minJWKSRefreshInterval = 10 * time.Second
+
+// maxJWKSSize limits the size of a JWKS fetched from the URL
+const maxJWKSSize = 1 << 20
+
+// jwks holds the public keys JWTs are signed with. Keys are loaded from a file
+// once or fetched from a URL and refreshed in the background when needed
+type jwks struct {
+	file          string
+	url           string
+	refreshPeriod time.Duration
+	client        *http.Client
+
+	// *jwkKeys, replaced as a whole by a refresh, so that reading the keys never waits for the JWKS
+	// to be fetched
+	keys atomic.Value
+	// Guards the time of the last load attempt and the refresh in flight
+	mu       sync.Mutex
+	loadedAt time.Time
+	// Closed once the refresh in flight is done. Nil if there is none
+	refreshed chan struct{}
+}
+
+// newJWKS loads the JWKS from the file or the URL of the config
+func newJWKS(config *relayutil.JWTConfig) (*jwks, error) {
+	set := &jwks{
+		file:          config.JWKSFile,
+		url:           config.JWKSURL,
+		refreshPeriod: relayutil.GetDurationInSeconds(config.JWKSRefreshPeriod),
+		client:        &http.Client{Timeout: 5 * time.Second},
+		loadedAt:      time.Now(),
+	}
+	if err := set.load(); err != nil {
+		return nil, err
+	}
+	return set, nil
+}
+
+// load reads the JWKS. The previous keys are kept if it fails
+func (set *jwks) load() error {
+	var data []byte
+	var err error
+	if set.file != "" {
+		data, err = os.ReadFile(set.file)
+	} else {
+		data, err = set.fetch()
+	}
+	if err != nil {
+		return err
+	}
+
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return err
+	}
+	set.keys.Store(keys)
+	return nil
+}
+
+// getCurrentKeys returns the current keys
+func (set *jwks) getCurrentKeys() *jwkKeys {
+	return set.keys.Load().(*jwkKeys)
+}
+
+// startRefresh fetches the JWKS in the background unless a refresh is already in flight. set.mu has
+// to be held by the caller
+func (set *jwks) startRefresh() {
+	if set.refreshed != nil {
+		return
+	}
+	set.loadedAt = time.Now()
+	refreshed := make(chan struct{})
+	set.refreshed = refreshed
+
+	go func() {
+		if err := set.load(); err != nil {
+			log.Errorln("error during JWKS refresh", err)
+		}
+		set.mu.Lock()
+		set.refreshed = nil
+		set.mu.Unlock()
+		close(refreshed)
+	}()
+}
+
+// fetch downloads the JWKS from the URL
+func (set *jwks) fetch() ([]byte, error) {
+	resp, err := set.client.Get(set.url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("JWKS request failed with HTTP status %d", resp.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxJWKSSize))
+}
+
+// getKeys returns the keys which may have signed a token with the given key id. Every key may have
+// signed a token without a key id. Tokens signed with an unknown key wait for the refresh in flight,
+// the rest are checked against the current keys
+func (set *jwks) getKeys(kid string) []crypto.PublicKey {
+	if set.file == "" {
+		_, isKnown := set.getCurrentKeys().byKid[kid]
+		set.mu.Lock()
+		sinceLoad := time.Since(set.loadedAt)
+		if sinceLoad > set.refreshPeriod || (kid != "" && !isKnown && sinceLoad > minJWKSRefreshInterval) {
+			set.startRefresh()
+		}
+		refreshed := set.refreshed
+		set.mu.Unlock()
+
+		if refreshed != nil && kid != "" && !isKnown {
+			<-refreshed
+		}
+	}
+
+	keys := set.getCurrentKeys()
+	if kid != "" {
+		return keys.byKid[kid]
+	}
+	return keys.all
+}
+
+// jwkKeys are the signing keys of a JWKS. Keys without a key id are only a part of all
+type jwkKeys struct {
+	byKid map[string][]crypto.PublicKey
+	all   []crypto.PublicKey
+}
+
+// jsonWebKey is a JSON Web Key (RFC 7517) holding an RSA or an EC public key
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+	// EC
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// parseJWKS parses the signing keys of a JWKS. Keys of other types and uses are skipped
+func parseJWKS(data []byte) (*jwkKeys, error) {
+	var set struct {
+		Keys []*jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("invalid JWKS: %w", err)
+	}
+
+	keys := &jwkKeys{byKid: make(map[string][]crypto.PublicKey, len(set.Keys))}
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		var key crypto.PublicKey
+		var err error
+		switch jwk.Kty {
+		case "RSA":
+			key, err = jwk.getRSAKey()
+		case "EC":
+			key, err = jwk.getECKey()
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid JWKS key %q: %w", jwk.Kid, err)
+		}
+		keys.all = append(keys.all, key)
+		if jwk.Kid != "" {
+			keys.byKid[jwk.Kid] = append(keys.byKid[jwk.Kid], key)
+		}
+	}
+	return keys, nil
+}
+
+// decodeBigInt decodes a base64url-encoded big-endian integer
+func decodeBigInt(value string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, fmt.Errorf("empty value")
+	}
+	return new(big.Int).SetBytes(data), nil
+}
+
+func (jwk *jsonWebKey) getRSAKey() (*rsa.PublicKey, error) {
+	n, err := decodeBigInt(jwk.N)
+	if err != nil {
+		return nil, err
+	}
+	e, err := decodeBigInt(jwk.E)
+	if err != nil {
+		return nil, err
+	}
+	if !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+		return nil, fmt.Errorf("invalid RSA exponent")
+	}
+	return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+}
+
+func (jwk *jsonWebKey) getECKey() (*ecdsa.PublicKey, error) {
+	var curve elliptic.Curve
+	switch jwk.Crv {
+	case "P-256":
+		curve = elliptic.P256()
+	case "P-384":
+		curve = elliptic.P384()
+	case "P-521":
+		curve = elliptic.P521()
+	default:
+		return nil, fmt.Errorf("unsupported curve %q", jwk.Crv)
+	}
+	x, err := decodeBigInt(jwk.X)
+	if err != nil {
+		return nil, err
+	}
+	y, err := decodeBigInt(jwk.Y)
+	if err != nil {
+		return nil, err
+	}
+	if !curve.IsOnCurve(x, y) {
+		return nil, fmt.Errorf("point is not on the curve")
+	}
+	return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+}
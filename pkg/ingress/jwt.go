@@ -0,0 +1,226 @@
+package ingress
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/parkanaur/rpc-relay/pkg/relayutil"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// jwtHashes holds the supported signature algorithms and their hash functions. Symmetric algorithms
+// and "none" are not supported
+var jwtHashes = map[string]crypto.Hash{
+	"RS256": crypto.SHA256,
+	"RS384": crypto.SHA384,
+	"RS512": crypto.SHA512,
+	"PS256": crypto.SHA256,
+	"PS384": crypto.SHA384,
+	"PS512": crypto.SHA512,
+	"ES256": crypto.SHA256,
+	"ES384": crypto.SHA384,
+	"ES512": crypto.SHA512,
+}
+
+// jwtCurveBitSizes holds the curve sizes the ECDSA algorithms require
+var jwtCurveBitSizes = map[string]int{"ES256": 256, "ES384": 384, "ES512": 521}
+
+// jwtHeader is the JOSE header of a JWT
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// jwtValidator validates JWT bearer tokens and maps their claims to callers
+type jwtValidator struct {
+	config *relayutil.JWTConfig
+	keys   *jwks
+}
+
+// newJWTValidator loads the JWKS of the config
+func newJWTValidator(config *relayutil.JWTConfig) (*jwtValidator, error) {
+	if err := config.Init(); err != nil {
+		return nil, err
+	}
+	keys, err := newJWKS(config)
+	if err != nil {
+		return nil, err
+	}
+	return &jwtValidator{config, keys}, nil
+}
+
+// isJWT checks whether the bearer token looks like a JWT rather than an API key
+func isJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// validate checks the signature and the claims of the token and returns the claims
+func (validator *jwtValidator) validate(token string) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed JWT")
+	}
+
+	var header jwtHeader
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("malformed JWT header: %w", err)
+	}
+	hash, ok := jwtHashes[header.Alg]
+	if !ok {
+		return nil, fmt.Errorf("unsupported JWT algorithm %q", header.Alg)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed JWT signature: %w", err)
+	}
+
+	digest := hash.New()
+	digest.Write([]byte(parts[0] + "." + parts[1]))
+	hashed := digest.Sum(nil)
+	isVerified := false
+	for _, key := range validator.keys.getKeys(header.Kid) {
+		if verifyJWTSignature(header.Alg, hash, key, hashed, signature) {
+			isVerified = true
+			break
+		}
+	}
+	if !isVerified {
+		return nil, fmt.Errorf("invalid JWT signature, key id %q", header.Kid)
+	}
+
+	var claims map[string]any
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("malformed JWT claims: %w", err)
+	}
+	if err := validator.checkClaims(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// decodeJWTPart decodes a base64url-encoded JSON part of a JWT
+func decodeJWTPart(part string, value any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode(value)
+}
+
+// verifyJWTSignature checks the signature of the hashed header and claims with the key. The key has to
+// be of the type the algorithm requires
+func verifyJWTSignature(alg string, hash crypto.Hash, key crypto.PublicKey, hashed, signature []byte) bool {
+	switch alg[:2] {
+	case "RS":
+		rsaKey, ok := key.(*rsa.PublicKey)
+		return ok && rsa.VerifyPKCS1v15(rsaKey, hash, hashed, signature) == nil
+	case "PS":
+		rsaKey, ok := key.(*rsa.PublicKey)
+		return ok && rsa.VerifyPSS(rsaKey, hash, hashed, signature,
+			&rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}) == nil
+	case "ES":
+		ecKey, ok := key.(*ecdsa.PublicKey)
+		if !ok || ecKey.Curve.Params().BitSize != jwtCurveBitSizes[alg] {
+			return false
+		}
+		// The signature is the concatenation of fixed-size r and s
+		size := (ecKey.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		return ecdsa.Verify(ecKey, hashed, r, s)
+	}
+	return false
+}
+
+// getNumericDate returns the value of a NumericDate claim such as "exp"
+func getNumericDate(claims map[string]any, name string) (time.Time, bool, error) {
+	value, ok := claims[name]
+	if !ok {
+		return time.Time{}, false, nil
+	}
+	number, ok := value.(json.Number)
+	if !ok {
+		return time.Time{}, false, fmt.Errorf("JWT claim %q is not a number", name)
+	}
+	seconds, err := number.Float64()
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("JWT claim %q is not a number", name)
+	}
+	return time.Unix(0, int64(seconds*float64(time.Second))), true, nil
+}
+
+// checkClaims checks the expiration, the issuer, the audience and the caller name of the token
+func (validator *jwtValidator) checkClaims(claims map[string]any) error {
+	now := time.Now()
+	skew := relayutil.GetDurationInSeconds(validator.config.ClockSkew)
+
+	expiresAt, ok, err := getNumericDate(claims, "exp")
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("JWT without an expiration time")
+	}
+	if now.After(expiresAt.Add(skew)) {
+		return errors.New("expired JWT")
+	}
+	notBefore, ok, err := getNumericDate(claims, "nbf")
+	if err != nil {
+		return err
+	}
+	if ok && now.Before(notBefore.Add(-skew)) {
+		return errors.New("JWT is not valid yet")
+	}
+
+	if issuer := validator.config.Issuer; issuer != "" && claims["iss"] != issuer {
+		return fmt.Errorf("invalid JWT issuer %v", claims["iss"])
+	}
+	if audience := validator.config.Audience; audience != "" && !hasAudience(claims["aud"], audience) {
+		return fmt.Errorf("invalid JWT audience %v", claims["aud"])
+	}
+	if name, _ := claims[validator.config.NameClaim].(string); name == "" {
+		return fmt.Errorf("JWT without the %q claim", validator.config.NameClaim)
+	}
+	return nil
+}
+
+// hasAudience checks whether the "aud" claim, either a string or an array of strings, contains the audience
+func hasAudience(claim any, audience string) bool {
+	switch claim := claim.(type) {
+	case string:
+		return claim == audience
+	case []any:
+		for _, value := range claim {
+			if value == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// newCaller creates the caller for the claims of a valid token. The caller may call the methods of
+// every matching claim policy
+func (validator *jwtValidator) newCaller(claims map[string]any) *rpcCaller {
+	tokenCaller := &rpcCaller{Name: claims[validator.config.NameClaim].(string)}
+	for _, policy := range validator.config.ClaimPolicies {
+		if policy.Matches(claims) {
+			tokenCaller.permissions = append(tokenCaller.permissions, policy)
+		}
+	}
+	return tokenCaller
+}
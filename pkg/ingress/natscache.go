@@ -0,0 +1,122 @@
+package ingress
+
+import (
+	"encoding/base64"
+	"fmt"
+	"github.com/nats-io/nats.go"
+	"github.com/parkanaur/rpc-relay/pkg/egress"
+	"github.com/parkanaur/rpc-relay/pkg/relayutil"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+// NATSCache stores cached requests in a JetStream key-value bucket, so that the cache is shared between
+// ingress replicas without any additional infrastructure.
+// JetStream only supports a TTL for the whole bucket, so the bucket keeps the requests for the longest
+// expiration threshold + ingress.staleIfErrorThreshold seconds, and the expiry time of each request is
+// also checked during retrieval
+type NATSCache struct {
+	kv     nats.KeyValue
+	config *relayutil.Config
+}
+
+// NewNATSCache opens the key-value bucket from the ingress.natsKeyValue config key, creating it if necessary
+func NewNATSCache(config *relayutil.Config, nc *nats.Conn) (*NATSCache, error) {
+	kvConfig := config.Ingress.NATSKeyValue
+	if kvConfig == nil {
+		return nil, fmt.Errorf("missing natsKeyValue config")
+	}
+
+	js, err := nc.JetStream()
+	if err != nil {
+		return nil, err
+	}
+
+	kv, err := js.KeyValue(kvConfig.BucketName)
+	if err == nats.ErrBucketNotFound {
+		kv, err = js.CreateKeyValue(&nats.KeyValueConfig{
+			Bucket:   kvConfig.BucketName,
+			History:  1,
+			TTL:      getRetentionPeriod(config),
+			MaxBytes: kvConfig.MaxBytes,
+			Replicas: kvConfig.Replicas,
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+	log.Infoln("Opened key-value bucket", kvConfig.BucketName)
+
+	return &NATSCache{kv: kv, config: config}, nil
+}
+
+// getRetentionPeriod returns the time cached requests are stored for, including the stale-if-error period
+func getRetentionPeriod(config *relayutil.Config) time.Duration {
+	return relayutil.GetDurationInSeconds(
+		config.Ingress.GetMaxExpireCachedRequestThreshold() + config.Ingress.StaleIfErrorThreshold)
+}
+
+// getBucketKey returns the bucket key for the request key. Bucket keys are restricted to a small set of
+// characters, so the request key is encoded
+func getBucketKey(requestKey string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(requestKey))
+}
+
+// Add adds a new RPCRequest and its response to the cache
+func (cache *NATSCache) Add(request *egress.RPCRequest, response *egress.RPCRawResponse) {
+	requestKey := request.GetRequestKey()
+	value, err := encodeCachedRequest(request, response, getExpirationThreshold(cache.config, request))
+	if err != nil {
+		log.Errorln("Failed to encode cached request for key-value bucket:", requestKey, err)
+		return
+	}
+
+	if _, err := cache.kv.Put(getBucketKey(requestKey), value); err != nil {
+		log.Errorln("Failed to add request to key-value bucket:", requestKey, err)
+	}
+}
+
+// GetRequestByKey searches for and returns the cached request by its key. JetStream failures are logged
+// and treated as cache misses
+func (cache *NATSCache) GetRequestByKey(requestKey string) (*CachedRequest, bool) {
+	entry, err := cache.kv.Get(getBucketKey(requestKey))
+	if err != nil {
+		if err != nats.ErrKeyNotFound {
+			log.Errorln("Failed to get request from key-value bucket:", requestKey, err)
+		}
+		return nil, false
+	}
+
+	cachedRequest, err := decodeCachedRequest(entry.Value())
+	if err != nil {
+		log.Errorln("Bad cached request in key-value bucket:", requestKey, err)
+		return nil, false
+	}
+	// The request may be retained by the bucket for longer than required
+	staleIfError := relayutil.GetDurationInSeconds(cache.config.Ingress.StaleIfErrorThreshold)
+	if time.Now().After(cachedRequest.ExpiryTime.Add(staleIfError)) {
+		return nil, false
+	}
+	return cachedRequest, true
+}
+
+// RemoveByKey removes a request from the cache by its key
+func (cache *NATSCache) RemoveByKey(requestKey string) error {
+	bucketKey := getBucketKey(requestKey)
+	if _, err := cache.kv.Get(bucketKey); err != nil {
+		if err == nats.ErrKeyNotFound {
+			return fmt.Errorf("request not found in cache")
+		}
+		return err
+	}
+	return cache.kv.Delete(bucketKey)
+}
+
+// Start does nothing since the requests are expired by JetStream
+func (cache *NATSCache) Start() {
+}
+
+// Stop does nothing since the NATS connection is owned by the ingress server
+func (cache *NATSCache) Stop() {
+	log.Infoln("Stopped cache")
+}
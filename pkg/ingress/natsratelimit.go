@@ -0,0 +1,189 @@
+package ingress
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/nats-io/nats.go"
+	"github.com/parkanaur/rpc-relay/pkg/relayutil"
+	log "github.com/sirupsen/logrus"
+	"hash/fnv"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Timeout of JetStream requests made by NATSRateLimiter. Calls wait for the rate limiter, so it is
+	// much shorter than the default JetStream timeout
+	natsRateLimitTimeout = 500 * time.Millisecond
+	// Number of attempts to update a bucket changed concurrently by another replica
+	natsRateLimitMaxAttempts = 10
+	// Time the local limits are used for after a JetStream failure before JetStream is tried again
+	natsRateLimitFallbackPeriod = 5 * time.Second
+	// Maximum time to wait before the first retry of a conflicting update. Increases with every attempt
+	natsRateLimitBackoff = time.Millisecond
+	// Number of locks serializing the updates of the buckets within a replica
+	natsRateLimitLocks = 64
+)
+
+var (
+	// errTooManyConflicts is returned if a bucket could not be updated because of concurrent updates
+	errTooManyConflicts = errors.New("too many concurrent updates")
+	// errFallingBack is returned if the local limits have to be used
+	errFallingBack = errors.New("falling back to local limits")
+)
+
+// NATSRateLimiter keeps the buckets in a JetStream key-value bucket, so that the limits are shared between
+// ingress replicas. Buckets are updated with optimistic concurrency control: an update only succeeds if
+// the bucket was not changed since it was read, and is retried otherwise.
+// If JetStream fails, the calls are counted by a local MemoryRateLimiter for a while, so that the limits
+// still apply to each replica separately
+type NATSRateLimiter struct {
+	kv nats.KeyValue
+	// Updates of a bucket are serialized within the replica, so that only the calls made to other
+	// replicas may conflict. Buckets are assigned to the locks by the hash of the key
+	locks [natsRateLimitLocks]sync.Mutex
+	// Limiter used while JetStream is unavailable
+	fallback *MemoryRateLimiter
+	// Time in Unix nanoseconds until which the fallback limiter is used
+	fallbackUntil int64
+}
+
+// NewNATSRateLimiter opens the key-value bucket from the ingress.rateLimit.natsKeyValue config key,
+// creating it if necessary
+func NewNATSRateLimiter(config *relayutil.RateLimitConfig, nc *nats.Conn) (*NATSRateLimiter, error) {
+	kvConfig := config.NATSKeyValue
+	if kvConfig == nil {
+		return nil, fmt.Errorf("missing rate limit natsKeyValue config")
+	}
+
+	js, err := nc.JetStream(nats.MaxWait(natsRateLimitTimeout))
+	if err != nil {
+		return nil, err
+	}
+
+	kv, err := js.KeyValue(kvConfig.BucketName)
+	if err == nats.ErrBucketNotFound {
+		// Buckets are dropped once they are idle, i.e. back to their initial state
+		kv, err = js.CreateKeyValue(&nats.KeyValueConfig{
+			Bucket:   kvConfig.BucketName,
+			History:  1,
+			TTL:      config.GetMaxIdlePeriod(),
+			MaxBytes: kvConfig.MaxBytes,
+			Replicas: kvConfig.Replicas,
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+	log.Infoln("Opened rate limit key-value bucket", kvConfig.BucketName)
+
+	return &NATSRateLimiter{kv: kv, fallback: NewMemoryRateLimiter()}, nil
+}
+
+// Take counts the call in the shared bucket, or in the local one if JetStream is unavailable
+func (limiter *NATSRateLimiter) Take(key string, limit *relayutil.RateLimit, cost float64) (*RateLimitStatus, error) {
+	return limiter.update(key, limit, func(bucket *tokenBucket, now time.Time) *RateLimitStatus {
+		return bucket.take(now, limit, cost)
+	}, func() (*RateLimitStatus, error) {
+		return limiter.fallback.Take(key, limit, cost)
+	})
+}
+
+// Charge takes the cost from the shared bucket, or from the local one if JetStream is unavailable
+func (limiter *NATSRateLimiter) Charge(key string, limit *relayutil.RateLimit, cost float64) (*RateLimitStatus, error) {
+	return limiter.update(key, limit, func(bucket *tokenBucket, now time.Time) *RateLimitStatus {
+		return bucket.charge(now, limit, cost)
+	}, func() (*RateLimitStatus, error) {
+		return limiter.fallback.Charge(key, limit, cost)
+	})
+}
+
+// update applies the change to the shared bucket, calling fallback if the shared bucket can't be used
+func (limiter *NATSRateLimiter) update(key string, limit *relayutil.RateLimit, change bucketChange,
+	fallback func() (*RateLimitStatus, error)) (*RateLimitStatus, error) {
+	if !limiter.IsFallingBack() {
+		status, err := limiter.updateShared(key, change)
+		switch err {
+		case nil:
+			return status, nil
+		case errFallingBack:
+		case errTooManyConflicts:
+			// A busy bucket does not mean that JetStream is unavailable, so only this call is counted locally
+			log.Errorln("Failed to update the shared rate limit, counting the call locally:", key, err)
+		default:
+			log.Errorln("Failed to use the shared rate limit, falling back to local limits:", key, err)
+			atomic.StoreInt64(&limiter.fallbackUntil, time.Now().Add(natsRateLimitFallbackPeriod).UnixNano())
+		}
+	}
+	return fallback()
+}
+
+// IsFallingBack checks whether the local limits are used instead of the shared ones
+func (limiter *NATSRateLimiter) IsFallingBack() bool {
+	return time.Now().UnixNano() < atomic.LoadInt64(&limiter.fallbackUntil)
+}
+
+// updateShared reads the bucket, applies the change and writes the bucket back unless another replica
+// has changed it in the meantime
+func (limiter *NATSRateLimiter) updateShared(key string, change bucketChange) (*RateLimitStatus, error) {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	lock := &limiter.locks[hash.Sum32()%natsRateLimitLocks]
+	lock.Lock()
+	defer lock.Unlock()
+	// JetStream may have failed while waiting for the lock
+	if limiter.IsFallingBack() {
+		return nil, errFallingBack
+	}
+
+	bucketKey := getBucketKey(key)
+	for attempt := 0; attempt < natsRateLimitMaxAttempts; attempt++ {
+		var bucket tokenBucket
+		var revision uint64
+		entry, err := limiter.kv.Get(bucketKey)
+		if err != nil && err != nats.ErrKeyNotFound {
+			return nil, err
+		}
+		if err == nil {
+			revision = entry.Revision()
+			// A bad bucket is replaced with a new one
+			if err := json.Unmarshal(entry.Value(), &bucket); err != nil {
+				log.Errorln("Bad rate limit bucket in key-value bucket:", key, err)
+				bucket = tokenBucket{}
+			}
+		}
+
+		status := change(&bucket, time.Now())
+		value, err := json.Marshal(&bucket)
+		if err != nil {
+			return nil, err
+		}
+		if revision == 0 {
+			_, err = limiter.kv.Create(bucketKey, value)
+		} else {
+			_, err = limiter.kv.Update(bucketKey, value, revision)
+		}
+		if err == nil {
+			return status, nil
+		}
+		if !limiter.hasChanged(bucketKey, revision) {
+			return nil, err
+		}
+		// Backing off for a random time, so that the replicas don't keep updating the bucket in lockstep
+		time.Sleep(time.Duration(rand.Int63n(int64(attempt+1) * int64(natsRateLimitBackoff))))
+	}
+	return nil, errTooManyConflicts
+}
+
+// hasChanged checks whether the key was changed since it was read at the given revision, which tells
+// a conflicting update from a failed one. nats.go does not expose the JetStream error code of the update
+func (limiter *NATSRateLimiter) hasChanged(bucketKey string, revision uint64) bool {
+	entry, err := limiter.kv.Get(bucketKey)
+	if err == nats.ErrKeyNotFound {
+		return revision != 0
+	}
+	return err == nil && entry.Revision() != revision
+}
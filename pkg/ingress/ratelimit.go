@@ -0,0 +1,267 @@
+package ingress
+
+import (
+	"fmt"
+	"github.com/nats-io/nats.go"
+	"github.com/parkanaur/rpc-relay/pkg/relayutil"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Rate limiter backends available in ingress.rateLimit.backend config key
+const (
+	RateLimitBackendMemory string = "memory"
+	RateLimitBackendNATS   string = "nats"
+)
+
+// RateLimiter counts the calls of the clients against their limits
+type RateLimiter interface {
+	// Take takes the cost of the call from the bucket with the given key and counts it towards the daily
+	// quota of the bucket if the limit allows the call
+	Take(key string, limit *relayutil.RateLimit, cost float64) (*RateLimitStatus, error)
+	// Charge takes the cost from the bucket with the given key and counts it towards the daily quota
+	// regardless of the limit. Used for the costs known only after the call, the bucket may go into debt
+	Charge(key string, limit *relayutil.RateLimit, cost float64) (*RateLimitStatus, error)
+}
+
+// NewRateLimiter creates a rate limiter using the backend from the config. NATS connection is used by
+// the "nats" backend
+func NewRateLimiter(config *relayutil.RateLimitConfig, nc *nats.Conn) (RateLimiter, error) {
+	if err := validateRateLimitConfig(config); err != nil {
+		return nil, err
+	}
+	switch config.Backend {
+	case "", RateLimitBackendMemory:
+		return NewMemoryRateLimiter(), nil
+	case RateLimitBackendNATS:
+		return NewNATSRateLimiter(config, nc)
+	default:
+		return nil, fmt.Errorf("unknown rate limiter backend: %v", config.Backend)
+	}
+}
+
+// RateLimitStatus is the state of a bucket after a call
+type RateLimitStatus struct {
+	// Set if the call is allowed
+	Allowed bool
+	// Set if the call is not allowed because of the daily quota
+	QuotaExceeded bool
+	// Bucket size and the number of tokens left. Zero if only the quota applies
+	Limit     int
+	Remaining int
+	// Time until the bucket is full again
+	Reset time.Duration
+	// Daily quota and the number of tokens left. Zero if there is no quota
+	QuotaLimit     int
+	QuotaRemaining int
+	// Time until the quota is reset
+	QuotaReset time.Duration
+	// Time until the call can be made again. Set for calls which are not allowed
+	RetryAfter time.Duration
+}
+
+// formatSeconds formats the duration as a number of seconds rounded up, as used in HTTP headers
+func formatSeconds(duration time.Duration) string {
+	return strconv.FormatInt(int64(math.Ceil(duration.Seconds())), 10)
+}
+
+// setHeaders sets the X-RateLimit-* headers and, for calls which are not allowed, the Retry-After header
+func (status *RateLimitStatus) setHeaders(header http.Header) {
+	if status.Limit > 0 {
+		header.Set("X-RateLimit-Limit", strconv.Itoa(status.Limit))
+		header.Set("X-RateLimit-Remaining", strconv.Itoa(status.Remaining))
+		header.Set("X-RateLimit-Reset", formatSeconds(status.Reset))
+	}
+	if status.QuotaLimit > 0 {
+		header.Set("X-RateLimit-Quota-Limit", strconv.Itoa(status.QuotaLimit))
+		header.Set("X-RateLimit-Quota-Remaining", strconv.Itoa(status.QuotaRemaining))
+		header.Set("X-RateLimit-Quota-Reset", formatSeconds(status.QuotaReset))
+	}
+	if !status.Allowed {
+		header.Set("Retry-After", formatSeconds(status.RetryAfter))
+	}
+}
+
+// quotaDay is the length of the quota period. Quotas are reset at midnight UTC
+const quotaDay = 24 * time.Hour
+
+// tokenBucket is the state of a bucket of a client. It is kept by the rate limiter backends
+type tokenBucket struct {
+	Tokens    float64
+	UpdatedAt time.Time
+	// Number of the day the quota is counted for, starting from the Unix epoch
+	QuotaDay  int64
+	QuotaUsed float64
+}
+
+// take refills the bucket for the time passed since the last call and takes the cost of the call if
+// the limit allows it. Calls which cost more than the bucket size are allowed when the bucket is full
+// and leave it in debt, so that they are not rejected forever. The quota is checked before the call,
+// so the last call of the day may exceed it
+func (bucket *tokenBucket) take(now time.Time, limit *relayutil.RateLimit, cost float64) *RateLimitStatus {
+	quotaReset := bucket.refill(now, limit)
+	required := math.Min(cost, float64(limit.GetBurst()))
+
+	status := &RateLimitStatus{}
+	switch {
+	case limit.DailyQuota > 0 && bucket.QuotaUsed >= float64(limit.DailyQuota):
+		status.QuotaExceeded = true
+		status.RetryAfter = quotaReset
+	case limit.Rate > 0 && bucket.Tokens < required:
+		status.RetryAfter = time.Duration((required - bucket.Tokens) / limit.Rate * float64(time.Second))
+	default:
+		status.Allowed = true
+		bucket.spend(limit, cost)
+	}
+	bucket.setStatus(status, limit, quotaReset)
+	return status
+}
+
+// charge refills the bucket for the time passed since the last call and takes the cost regardless of
+// the limit
+func (bucket *tokenBucket) charge(now time.Time, limit *relayutil.RateLimit, cost float64) *RateLimitStatus {
+	quotaReset := bucket.refill(now, limit)
+	bucket.spend(limit, cost)
+	status := &RateLimitStatus{Allowed: true}
+	bucket.setStatus(status, limit, quotaReset)
+	return status
+}
+
+// spend takes the cost from the bucket and counts it towards the daily quota
+func (bucket *tokenBucket) spend(limit *relayutil.RateLimit, cost float64) {
+	if limit.Rate > 0 {
+		bucket.Tokens -= cost
+	}
+	bucket.QuotaUsed += cost
+}
+
+// refill adds the tokens for the time passed since the last call and starts a new quota day if needed.
+// Returns the time until the quota is reset
+func (bucket *tokenBucket) refill(now time.Time, limit *relayutil.RateLimit) time.Duration {
+	burst := float64(limit.GetBurst())
+	if bucket.UpdatedAt.IsZero() {
+		bucket.Tokens = burst
+	} else if limit.Rate > 0 {
+		bucket.Tokens = math.Min(burst, bucket.Tokens+now.Sub(bucket.UpdatedAt).Seconds()*limit.Rate)
+	}
+	bucket.UpdatedAt = now
+	if day := now.Unix() / int64(quotaDay.Seconds()); bucket.QuotaDay != day {
+		bucket.QuotaDay = day
+		bucket.QuotaUsed = 0
+	}
+	return time.Unix((bucket.QuotaDay+1)*int64(quotaDay.Seconds()), 0).Sub(now)
+}
+
+// setStatus fills in the state of the bucket. Buckets in debt or over the quota have no tokens left
+func (bucket *tokenBucket) setStatus(status *RateLimitStatus, limit *relayutil.RateLimit, quotaReset time.Duration) {
+	if limit.Rate > 0 {
+		burst := float64(limit.GetBurst())
+		status.Limit = int(burst)
+		status.Remaining = int(math.Max(0, math.Floor(bucket.Tokens)))
+		status.Reset = time.Duration((burst - bucket.Tokens) / limit.Rate * float64(time.Second))
+	}
+	if limit.DailyQuota > 0 {
+		status.QuotaLimit = limit.DailyQuota
+		status.QuotaRemaining = int(math.Max(0, math.Floor(float64(limit.DailyQuota)-bucket.QuotaUsed)))
+		status.QuotaReset = quotaReset
+	}
+}
+
+// getIdleTime returns the time after which the bucket is back to its initial state and may be dropped
+func (bucket *tokenBucket) getIdleTime(limit *relayutil.RateLimit) time.Time {
+	idleTime := bucket.UpdatedAt
+	if limit.Rate > 0 {
+		idleTime = idleTime.Add(
+			time.Duration((float64(limit.GetBurst()) - bucket.Tokens) / limit.Rate * float64(time.Second)))
+	}
+	if limit.DailyQuota > 0 && bucket.QuotaUsed > 0 {
+		if quotaReset := time.Unix((bucket.QuotaDay+1)*int64(quotaDay.Seconds()), 0); quotaReset.After(idleTime) {
+			idleTime = quotaReset
+		}
+	}
+	return idleTime
+}
+
+// bucketChange takes tokens from the bucket, see tokenBucket.take and tokenBucket.charge
+type bucketChange func(bucket *tokenBucket, now time.Time) *RateLimitStatus
+
+// rateLimitSweepPeriod is how often MemoryRateLimiter drops idle buckets
+const rateLimitSweepPeriod = time.Minute
+
+// memoryBucket is a bucket of MemoryRateLimiter
+type memoryBucket struct {
+	tokenBucket
+	idleTime time.Time
+}
+
+// MemoryRateLimiter keeps the buckets in the ingress process. Idle buckets are dropped periodically
+type MemoryRateLimiter struct {
+	sync.Mutex
+	buckets   map[string]*memoryBucket
+	sweptTime time.Time
+}
+
+// NewMemoryRateLimiter creates an empty in-memory rate limiter
+func NewMemoryRateLimiter() *MemoryRateLimiter {
+	return &MemoryRateLimiter{buckets: make(map[string]*memoryBucket), sweptTime: time.Now()}
+}
+
+func (limiter *MemoryRateLimiter) Take(key string, limit *relayutil.RateLimit, cost float64) (*RateLimitStatus, error) {
+	return limiter.update(key, limit, func(bucket *tokenBucket, now time.Time) *RateLimitStatus {
+		return bucket.take(now, limit, cost)
+	}), nil
+}
+
+func (limiter *MemoryRateLimiter) Charge(key string, limit *relayutil.RateLimit, cost float64) (*RateLimitStatus, error) {
+	return limiter.update(key, limit, func(bucket *tokenBucket, now time.Time) *RateLimitStatus {
+		return bucket.charge(now, limit, cost)
+	}), nil
+}
+
+// update applies the change to the bucket with the given key, creating the bucket if needed
+func (limiter *MemoryRateLimiter) update(
+	key string, limit *relayutil.RateLimit, change bucketChange) *RateLimitStatus {
+	limiter.Lock()
+	defer limiter.Unlock()
+
+	now := time.Now()
+	if now.Sub(limiter.sweptTime) > rateLimitSweepPeriod {
+		limiter.sweep(now)
+	}
+
+	bucket, ok := limiter.buckets[key]
+	if !ok {
+		bucket = &memoryBucket{}
+		limiter.buckets[key] = bucket
+	}
+	status := change(&bucket.tokenBucket, now)
+	bucket.idleTime = bucket.getIdleTime(limit)
+	return status
+}
+
+// sweep drops the idle buckets
+func (limiter *MemoryRateLimiter) sweep(now time.Time) {
+	for key, bucket := range limiter.buckets {
+		if now.After(bucket.idleTime) {
+			delete(limiter.buckets, key)
+		}
+	}
+	limiter.sweptTime = now
+}
+
+// validateRateLimitConfig checks the client key settings of the rate limiting config
+func validateRateLimitConfig(config *relayutil.RateLimitConfig) error {
+	switch config.ClientKey {
+	case "", relayutil.RateLimitClientKeyCaller, relayutil.RateLimitClientKeyIP:
+	case relayutil.RateLimitClientKeyHeader:
+		if config.ClientHeader == "" {
+			return fmt.Errorf("rate limiting by header requires a client header")
+		}
+	default:
+		return fmt.Errorf("unknown rate limit client key: %v", config.ClientKey)
+	}
+	return nil
+}
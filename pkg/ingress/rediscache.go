@@ -0,0 +1,104 @@
+package ingress
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"github.com/parkanaur/rpc-relay/pkg/egress"
+	"github.com/parkanaur/rpc-relay/pkg/relayutil"
+	log "github.com/sirupsen/logrus"
+)
+
+// RedisCache stores cached requests in Redis, so that the cache is shared between ingress replicas.
+// Cached requests are expired by Redis itself, and the eviction is up to the Redis maxmemory policy
+type RedisCache struct {
+	client *redis.Client
+	config *relayutil.Config
+}
+
+// NewRedisCache connects to Redis using the ingress.redis config key
+func NewRedisCache(config *relayutil.Config) (*RedisCache, error) {
+	redisConfig := config.Ingress.Redis
+	if redisConfig == nil {
+		return nil, fmt.Errorf("missing redis config")
+	}
+
+	client := redis.NewClient(&redis.Options{
+		Addr:     redisConfig.Address,
+		Password: redisConfig.Password,
+		DB:       redisConfig.DB,
+	})
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+	log.Infoln("Connected to Redis", redisConfig.Address)
+
+	return &RedisCache{client: client, config: config}, nil
+}
+
+// getRedisKey returns the Redis key for the request key
+func (cache *RedisCache) getRedisKey(requestKey string) string {
+	return cache.config.Ingress.Redis.KeyPrefix + requestKey
+}
+
+// Add adds a new RPCRequest and its response to the cache. Redis expires the request after
+// its expiration threshold + ingress.staleIfErrorThreshold seconds
+func (cache *RedisCache) Add(request *egress.RPCRequest, response *egress.RPCRawResponse) {
+	requestKey := request.GetRequestKey()
+	expireAfter := getExpirationThreshold(cache.config, request)
+	value, err := encodeCachedRequest(request, response, expireAfter)
+	if err != nil {
+		log.Errorln("Failed to encode cached request for Redis:", requestKey, err)
+		return
+	}
+
+	err = cache.client.Set(context.Background(), cache.getRedisKey(requestKey), value,
+		expireAfter+relayutil.GetDurationInSeconds(cache.config.Ingress.StaleIfErrorThreshold)).Err()
+	if err != nil {
+		log.Errorln("Failed to add request to Redis:", requestKey, err)
+	}
+}
+
+// GetRequestByKey searches for and returns the cached request by its key. Redis failures are logged
+// and treated as cache misses
+func (cache *RedisCache) GetRequestByKey(requestKey string) (*CachedRequest, bool) {
+	value, err := cache.client.Get(context.Background(), cache.getRedisKey(requestKey)).Bytes()
+	if err != nil {
+		if err != redis.Nil {
+			log.Errorln("Failed to get request from Redis:", requestKey, err)
+		}
+		return nil, false
+	}
+
+	cachedRequest, err := decodeCachedRequest(value)
+	if err != nil {
+		log.Errorln("Bad cached request in Redis:", requestKey, err)
+		return nil, false
+	}
+	return cachedRequest, true
+}
+
+// RemoveByKey removes a request from the cache by its key
+func (cache *RedisCache) RemoveByKey(requestKey string) error {
+	numDeleted, err := cache.client.Del(context.Background(), cache.getRedisKey(requestKey)).Result()
+	if err != nil {
+		return err
+	}
+	if numDeleted == 0 {
+		return fmt.Errorf("request not found in cache")
+	}
+	return nil
+}
+
+// Start does nothing since the requests are expired by Redis
+func (cache *RedisCache) Start() {
+}
+
+// Stop closes the Redis connection
+func (cache *RedisCache) Stop() {
+	if err := cache.client.Close(); err != nil {
+		log.Errorln("Error while closing Redis connection:", err)
+	}
+	log.Infoln("Stopped cache")
+}
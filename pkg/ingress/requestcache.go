@@ -1,22 +1,40 @@
 package ingress
 
 import (
+	"container/heap"
+	"container/list"
+	"encoding/json"
 	"fmt"
 	"github.com/parkanaur/rpc-relay/pkg/egress"
 	"github.com/parkanaur/rpc-relay/pkg/relayutil"
 	log "github.com/sirupsen/logrus"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// Maximum number of requests removed by DeleteExpiredValues at once while holding the write lock
+const expiryBatchSize = 1000
+
 // CachedRequest holds the RPC request as well as the time it was added to the queue.
-// Response is also cached here as bytes
+// Response is also cached here
 type CachedRequest struct {
-	CTime   time.Time
-	Request *egress.RPCRequest
-	// egress.RPCResponse serialized into bytes. Since we don't need to unmarshal it at any point to return to the
-	// user, it's wise to keep it here as raw bytes.
-	Response []byte
+	CTime time.Time
+	// Time after which the request is expired, see ingress.expireCachedRequestThreshold and
+	// ingress.cachePolicies config keys
+	ExpiryTime time.Time
+	Request    *egress.RPCRequest
+	// Response with the result kept as raw bytes. Since we don't need to unmarshal the result at any point
+	// to return it to the user, it's wise to keep it as raw bytes. The id and jsonrpc fields are replaced
+	// with the caller's ones on every cache hit
+	Response *egress.RPCRawResponse
+	// Position of the request in the LRU list
+	element *list.Element
+	// Position of the request in the expiry queue
+	expiryIndex int
+	// Size of the request key, the request encoded as JSON and the response payload in bytes. The encoded
+	// request stands for the memory held by its parsed params
+	size int
 }
 
 // IsRequestStale compares the request cache time to current time and checks if it has exceeded the given
@@ -26,12 +44,24 @@ func (request *CachedRequest) IsRequestStale(timeToLive time.Duration) bool {
 }
 
 // RequestCache is a wrapper around the map which maps request keys (see RPCRequest) to
-// corresponding cached requests
+// corresponding cached requests. The cache is bounded by ingress.maxCacheEntries and
+// ingress.maxCacheBytes config keys, the least recently used requests are evicted first
 type RequestCache struct {
 	sync.RWMutex
 	// TODO: think of using sync.Map?
-	Cache  map[string]*CachedRequest
-	config *relayutil.Config
+	Cache map[string]*CachedRequest
+	// Request keys ordered from the most to the least recently used. Readers only hold the read lock
+	// of the cache, so lruLock is used for moving the keys around during lookups
+	lru     *list.List
+	lruLock sync.Mutex
+	// Requests ordered by their expiry time. Used for removing the expired requests without going
+	// through the whole cache
+	expiryQueue expiryQueue
+	// Total size of cached requests and responses in bytes
+	size int
+	// Number of requests evicted due to the cache limits
+	evictions uint64
+	config    *relayutil.Config
 	// Used for cleanup during shutdown
 	wg   *sync.WaitGroup
 	done chan bool
@@ -41,18 +71,73 @@ type RequestCache struct {
 func NewRequestCache(config *relayutil.Config) *RequestCache {
 	return &RequestCache{
 		Cache:  make(map[string]*CachedRequest),
+		lru:    list.New(),
 		config: config,
 		wg:     &sync.WaitGroup{},
 		done:   make(chan bool),
 	}
 }
 
-// Add adds a new RPCRequest and its response to the cache
-func (cache *RequestCache) Add(request *egress.RPCRequest, response []byte) {
+// Add adds a new RPCRequest and its response to the cache. The response id is not stored since
+// it belongs to the request which populated the cache, and neither is the caller of the request
+func (cache *RequestCache) Add(request *egress.RPCRequest, response *egress.RPCRawResponse) {
+	requestKey := request.GetRequestKey()
+	storedRequest := *request
+	storedRequest.Caller = ""
+	encodedRequest, err := json.Marshal(&storedRequest)
+	if err != nil {
+		log.Errorln("Failed to encode request for the cache", requestKey, err)
+		return
+	}
+
+	cTime := time.Now()
+	cachedRequest := &CachedRequest{
+		CTime:      cTime,
+		ExpiryTime: cTime.Add(getExpirationThreshold(cache.config, request)),
+		Request:    &storedRequest,
+		Response:   &egress.RPCRawResponse{Result: response.Result, Error: response.Error},
+		size:       len(requestKey) + len(encodedRequest) + len(response.Result) + len(response.Error),
+	}
+
+	maxBytes := cache.config.Ingress.MaxCacheBytes
+	if maxBytes > 0 && cachedRequest.size > maxBytes {
+		log.Infoln("Request is too big to be cached:", requestKey, cachedRequest.size)
+		return
+	}
+
 	cache.Lock()
 	defer cache.Unlock()
 
-	cache.Cache[request.GetRequestKey()] = &CachedRequest{time.Now(), request, response}
+	if oldRequest, ok := cache.Cache[requestKey]; ok {
+		cache.remove(requestKey, oldRequest)
+	}
+	cachedRequest.element = cache.lru.PushFront(requestKey)
+	heap.Push(&cache.expiryQueue, cachedRequest)
+	cache.Cache[requestKey] = cachedRequest
+	cache.size += cachedRequest.size
+
+	cache.evict()
+}
+
+// remove deletes the request from the cache. Write lock has to be held by the caller
+func (cache *RequestCache) remove(requestKey string, cachedRequest *CachedRequest) {
+	delete(cache.Cache, requestKey)
+	cache.lru.Remove(cachedRequest.element)
+	if cachedRequest.expiryIndex >= 0 {
+		heap.Remove(&cache.expiryQueue, cachedRequest.expiryIndex)
+	}
+	cache.size -= cachedRequest.size
+}
+
+// evict removes the least recently used requests until the cache fits into the configured limits.
+// Write lock has to be held by the caller
+func (cache *RequestCache) evict() {
+	maxEntries, maxBytes := cache.config.Ingress.MaxCacheEntries, cache.config.Ingress.MaxCacheBytes
+	for (maxEntries > 0 && len(cache.Cache) > maxEntries) || (maxBytes > 0 && cache.size > maxBytes) {
+		requestKey := cache.lru.Back().Value.(string)
+		cache.remove(requestKey, cache.Cache[requestKey])
+		atomic.AddUint64(&cache.evictions, 1)
+	}
 }
 
 // GetRequestByKey searches for and returns the cached request by its key
@@ -61,6 +146,11 @@ func (cache *RequestCache) GetRequestByKey(requestKey string) (*CachedRequest, b
 	defer cache.RUnlock()
 
 	request, ok := cache.Cache[requestKey]
+	if ok {
+		cache.lruLock.Lock()
+		cache.lru.MoveToFront(request.element)
+		cache.lruLock.Unlock()
+	}
 	return request, ok
 }
 
@@ -71,13 +161,14 @@ func (cache *RequestCache) GetRequestByValue(request *egress.RPCRequest) (*Cache
 
 // RemoveByKey removes a request from the cache by its key
 func (cache *RequestCache) RemoveByKey(requestKey string) error {
-	if _, ok := cache.GetRequestByKey(requestKey); !ok {
-		return fmt.Errorf("request not found in cache")
-	}
-
 	cache.Lock()
 	defer cache.Unlock()
-	delete(cache.Cache, requestKey)
+
+	cachedRequest, ok := cache.Cache[requestKey]
+	if !ok {
+		return fmt.Errorf("request not found in cache")
+	}
+	cache.remove(requestKey, cachedRequest)
 	return nil
 }
 
@@ -95,29 +186,44 @@ func (cache *RequestCache) RequestKeyStale(requestKey string, timeToLive time.Du
 	return cachedRequest.IsRequestStale(timeToLive)
 }
 
-// DeleteStaleValues runs through the whole cache and removes the old enough entries
-func (cache *RequestCache) DeleteStaleValues(timeToLive time.Duration) {
-	// TODO: Replace with a more efficient cleanup procedure.
-	// This is ineffective on bigger caches if cleanup interval if small and requests may
-	// slow down while garbage is being collected.
-	// Better solutions would be:
-	// A) using a queue along with a map to keep track of keys, periodically going over
-	// all the keys in the queue and checking if the values are stale,
-	// B) using an external implementation like
-	// https://github.com/allegro/bigcache (which does what is proposed in option A)
-	// or Redis.
-	cache.Lock()
-	defer cache.Unlock()
+// Size returns the total size of cached requests and responses in bytes
+func (cache *RequestCache) Size() int {
+	cache.RLock()
+	defer cache.RUnlock()
+
+	return cache.size
+}
+
+// Evictions returns the number of requests evicted due to the cache limits
+func (cache *RequestCache) Evictions() uint64 {
+	return atomic.LoadUint64(&cache.evictions)
+}
 
-	for requestKey, cachedRequest := range cache.Cache {
-		if cachedRequest.IsRequestStale(timeToLive) {
-			delete(cache.Cache, requestKey)
+// DeleteExpiredValues removes the requests which expired before the deadline. The requests are taken
+// from the expiry queue, so only the expired requests are visited. The write lock is released after
+// every expiryBatchSize requests to let the readers through
+func (cache *RequestCache) DeleteExpiredValues(deadline time.Time) {
+	for {
+		cache.Lock()
+		numDeleted := 0
+		for ; numDeleted < expiryBatchSize; numDeleted++ {
+			cachedRequest, ok := cache.expiryQueue.popExpired(deadline)
+			if !ok {
+				break
+			}
+			cache.remove(cachedRequest.element.Value.(string), cachedRequest)
+		}
+		cache.Unlock()
+
+		if numDeleted < expiryBatchSize {
+			return
 		}
 	}
 }
 
-// InvalidateStaleValuesLoop runs the DeleteStaleValues method every N seconds,
-// where N is defined by config's ingress.expireCachedRequestThreshold key
+// InvalidateStaleValuesLoop runs the DeleteExpiredValues method every N seconds,
+// where N is defined by config's ingress.invalidateCacheLoopSleepPeriod key. Requests are kept for
+// ingress.staleIfErrorThreshold seconds after they expire
 func (cache *RequestCache) InvalidateStaleValuesLoop() {
 	for {
 		select {
@@ -127,8 +233,9 @@ func (cache *RequestCache) InvalidateStaleValuesLoop() {
 			return
 		case <-time.After(relayutil.GetDurationInSeconds(cache.config.Ingress.InvalidateCacheLoopSleepPeriod)):
 			log.Infoln("Cleaning up cache, size:", len(cache.Cache))
-			cache.DeleteStaleValues(relayutil.GetDurationInSeconds(cache.config.Ingress.ExpireCachedRequestThreshold))
-			log.Infoln("Cache invalidated, size:", len(cache.Cache))
+			cache.DeleteExpiredValues(
+				time.Now().Add(-relayutil.GetDurationInSeconds(cache.config.Ingress.StaleIfErrorThreshold)))
+			log.Infoln("Cache invalidated, size:", len(cache.Cache), "evictions:", cache.Evictions())
 		}
 	}
 }
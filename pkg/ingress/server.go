@@ -1,129 +1,541 @@
 package ingress
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/nats-io/nats.go"
 	"github.com/parkanaur/rpc-relay/pkg/egress"
 	"github.com/parkanaur/rpc-relay/pkg/relayutil"
 	log "github.com/sirupsen/logrus"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"runtime/debug"
 	"sync"
+	"time"
 )
 
 // Server accepts HTTP JSON-RPC requests and proxies them to egress server via NATS
 // It also holds the requets cache and runs periodic cache invalidation
 type Server struct {
 	// RPC request cache
-	RequestCache *RequestCache
+	RequestCache Cache
+	// In-flight egress calls, used for coalescing identical requests
+	calls *callGroup
 	// NATS connection
 	NATSConnection *nats.Conn
 	// Channel which is written to during shutdown and read from by the shutdown function
 	done chan bool
 	// Waitgroup for NATS connection draining handling
 	wg *sync.WaitGroup
+	// API key authentication. Nil if authentication is disabled
+	auth *authenticator
+	// Nil if rate limiting is disabled
+	rateLimiter RateLimiter
 	// Server config
 	config *relayutil.Config
 }
 
 // SendRPCRequest creates a NATS request to egress and returns the NATS reply
 func (server *Server) SendRPCRequest(request *egress.RPCRequest) (*nats.Msg, error) {
-	msgData, err := json.Marshal(&request)
+	msg, err := egress.NewRequestMsg(
+		server.config.NATS.GetSubjectName(request.ModuleName, request.MethodName), request)
 	if err != nil {
 		return nil, err
 	}
 
-	return server.NATSConnection.Request(
-		server.config.NATS.GetSubjectName(request.ModuleName, request.MethodName),
-		msgData,
-		relayutil.GetDurationInSeconds(server.config.Ingress.NATSCallWaitTimeout))
+	return server.NATSConnection.RequestMsg(msg, relayutil.GetDurationInSeconds(server.config.Ingress.NATSCallWaitTimeout))
 }
 
-func (server *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	if req.Method != http.MethodPost {
-		http.Error(w, "invalid HTTP method: only POST is allowed", http.StatusMethodNotAllowed)
-		return
+// SendRPCNotification publishes a notification to egress without waiting for a reply
+func (server *Server) SendRPCNotification(request *egress.RPCRequest) error {
+	msg, err := egress.NewRequestMsg(
+		server.config.NATS.GetSubjectName(request.ModuleName, request.MethodName), request)
+	if err != nil {
+		return err
 	}
 
-	body, err := ioutil.ReadAll(req.Body)
+	return server.NATSConnection.PublishMsg(msg)
+}
+
+// callResult holds the serialized outcome of a single JSON-RPC call, be it a standalone request or
+// a part of a batch
+type callResult struct {
+	// Serialized RPCResponse or RPCErrorResponse. Nil for notifications
+	Response []byte
+	// HTTP status code used when the call is not a part of a batch
+	StatusCode int
+	// Cache usage during the call, used for the response headers when the call is not a part of a batch.
+	// Nil if the call did not get to the cache
+	Cache *cacheInfo
+	// Set for error responses
+	IsError   bool
+	ErrorCode egress.RPCErrorNum
+	// Rate limit of the client after the call, used for the response headers when the call is not a part
+	// of a batch. Nil if the call was not counted
+	RateLimit *RateLimitStatus
+}
+
+// newErrorResult creates a callResult holding a serialized RPCErrorResponse addressed to the request
+// with the given id
+func newErrorResult(statusCode int, id any, errNum egress.RPCErrorNum, info ...any) *callResult {
+	respJson, _ := json.Marshal(egress.CreateErrorResponse(id, errNum, info...))
+	return &callResult{Response: respJson, StatusCode: statusCode, IsError: true, ErrorCode: errNum}
+}
+
+// newResponseResult creates a callResult holding the response addressed to the given request
+func newResponseResult(rpcReq *egress.RPCRequest, rpcResp *egress.RPCRawResponse, cache *cacheInfo) *callResult {
+	response, err := rpcResp.WithRequest(rpcReq).Encode()
 	if err != nil {
-		log.Errorln("error during body reading", err)
-		http.Error(w, "internal error", http.StatusInternalServerError)
-		return
+		log.Errorln("error during response encoding", err)
+		return newErrorResult(http.StatusInternalServerError, rpcReq.ID, egress.RPCErrorInternalError)
+	}
+	if rpcResp.IsError() {
+		errorCode := egress.RPCErrorNum(egress.RPCErrorInternalError)
+		if rpcErr, err := rpcResp.GetError(); err == nil {
+			errorCode = rpcErr.Code
+		}
+		return &callResult{Response: response, StatusCode: http.StatusBadRequest, Cache: cache, IsError: true, ErrorCode: errorCode}
+	}
+	return &callResult{Response: response, StatusCode: http.StatusOK, Cache: cache}
+}
+
+// newRateLimitedResult creates a callResult for a call which the rate limit does not allow
+func newRateLimitedResult(rpcReq *egress.RPCRequest, status *RateLimitStatus) *callResult {
+	result := &callResult{StatusCode: http.StatusTooManyRequests}
+	if !rpcReq.IsNotification {
+		errNum := egress.RPCErrorNum(egress.RPCErrorRateLimited)
+		if status.QuotaExceeded {
+			errNum = egress.RPCErrorQuotaExceeded
+		}
+		result = newErrorResult(http.StatusTooManyRequests, rpcReq.ID, errNum)
 	}
+	result.RateLimit = status
+	return result
+}
+
+// egressError is a failure reply received from egress (see egress.EgressReply.IsFailure). Its response
+// is returned to the user if there is no cached response to fall back to
+type egressError struct {
+	Reply    *egress.EgressReply
+	Response *egress.RPCRawResponse
+}
+
+func (err *egressError) Error() string {
+	if err.Reply.Status == egress.ReplyStatusRelayError {
+		return fmt.Sprintf("egress failure: %v", err.Reply.ErrorClass)
+	}
+	return "jrpcserver internal error"
+}
 
-	rpcReq, err := egress.ParseCall(body)
+// fetchFromEgress sends the request to egress and caches the response if the cache policy allows it
+func (server *Server) fetchFromEgress(
+	rpcReq *egress.RPCRequest, reqKey string, policy *relayutil.CachePolicy) (*egress.RPCRawResponse, error) {
+	msg, err := server.SendRPCRequest(rpcReq)
 	if err != nil {
-		respObj := egress.CreateErrorResponse(egress.RPCErrorNotWellFormed, err)
-		respJson, _ := json.Marshal(respObj)
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write(respJson)
-		return
+		return nil, err
 	}
 
+	reply, err := egress.ParseEgressReply(msg.Data)
+	if err != nil {
+		return nil, fmt.Errorf("malformed egress reply: %w", err)
+	}
+	rpcResp, err := reply.GetResponse()
+	if err != nil {
+		return nil, fmt.Errorf("malformed egress reply: %w", err)
+	}
+	log.Infoln("Egress replied:", reqKey, reply.Status, reply.BackendDuration)
+
+	// Failures are not cached and are only returned if there is no cached response to fall back to.
+	// Forward the error RPC response as usual otherwise
+	if reply.IsFailure() {
+		return nil, &egressError{reply, rpcResp}
+	}
+
+	if policy.IsCacheable(len(rpcResp.Result) + len(rpcResp.Error)) {
+		server.RequestCache.Add(rpcReq, rpcResp)
+		log.Infoln("Added request to cache:", reqKey)
+	}
+	return rpcResp, nil
+}
+
+// fetchResponse sends the request to egress and caches the response. Concurrent calls with the same
+// request key are coalesced into a single egress call, and its response is shared between them,
+// unless the cache policy forbids caching
+func (server *Server) fetchResponse(
+	rpcReq *egress.RPCRequest, reqKey string, policy *relayutil.CachePolicy) (*egress.RPCRawResponse, error) {
+	if policy.NoCache {
+		return server.fetchFromEgress(rpcReq, reqKey, policy)
+	}
+
+	rpcResp, shared, err := server.calls.Do(reqKey, func() (*egress.RPCRawResponse, error) {
+		return server.fetchFromEgress(rpcReq, reqKey, policy)
+	})
+	if shared {
+		log.Infoln("Shared in-flight egress call:", reqKey)
+	}
+	return rpcResp, err
+}
+
+// refreshInBackground renews the cached request without waiting for the result. Nothing is done
+// if an egress call for the request is already in flight
+func (server *Server) refreshInBackground(rpcReq *egress.RPCRequest, reqKey string, policy *relayutil.CachePolicy) {
+	server.calls.Go(reqKey, func() (*egress.RPCRawResponse, error) {
+		rpcResp, err := server.fetchFromEgress(rpcReq, reqKey, policy)
+		if err != nil {
+			log.Errorln("error during background cache refresh", reqKey, err)
+		}
+		return rpcResp, err
+	})
+}
+
+// requestContext holds the details of an HTTP request shared by all of its calls
+type requestContext struct {
+	// Authenticated caller. Nil if authentication is disabled
+	Caller *rpcCaller
+	// Cache-Control directives of the user
+	Directives *CacheDirectives
+	// Client identity the rate limits apply to. Empty if rate limiting is disabled
+	ClientID string
+}
+
+// getClientID returns the client identity of the request according to the rate limiting config
+func (server *Server) getClientID(req *http.Request, caller *rpcCaller) string {
+	rateLimitConfig := server.config.Ingress.RateLimit
+	switch rateLimitConfig.ClientKey {
+	case relayutil.RateLimitClientKeyIP:
+	case relayutil.RateLimitClientKeyHeader:
+		if value := req.Header.Get(rateLimitConfig.ClientHeader); value != "" {
+			return "header:" + value
+		}
+	default:
+		if caller != nil {
+			return "caller:" + caller.Name
+		}
+	}
+
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// takeRateLimit counts the call with the request of the given size against the limit of the client
+// for the method. The status is nil if the calls are not limited. Calls are allowed if the rate
+// limiter fails
+func (server *Server) takeRateLimit(
+	rpcReq *egress.RPCRequest, reqCtx *requestContext, requestSize int) *RateLimitStatus {
+	if server.rateLimiter == nil {
+		return nil
+	}
+	rateLimitConfig := server.config.Ingress.RateLimit
+	scope, limit := rateLimitConfig.GetRateLimit(rpcReq.ModuleName, rpcReq.MethodName)
+	if limit == nil {
+		return nil
+	}
+
+	cost := rateLimitConfig.GetRPCMethodCost(rpcReq.ModuleName, rpcReq.MethodName).GetCallCost(requestSize)
+	status, err := server.rateLimiter.Take(reqCtx.ClientID+"|"+scope, limit, cost)
+	if err != nil {
+		log.Errorln("error during rate limiting", reqCtx.ClientID, err)
+		return nil
+	}
+	if !status.Allowed {
+		log.Infoln("Rate limit exceeded:", reqCtx.ClientID, rpcReq.Method)
+	}
+	return status
+}
+
+// chargeRateLimit takes the cost of the response of the given size from the limit of the client for
+// the method. Returns the status after the charge, or the given one if nothing is charged
+func (server *Server) chargeRateLimit(rpcReq *egress.RPCRequest, reqCtx *requestContext,
+	status *RateLimitStatus, responseSize int) *RateLimitStatus {
+	if status == nil {
+		return nil
+	}
+	rateLimitConfig := server.config.Ingress.RateLimit
+	cost := rateLimitConfig.GetRPCMethodCost(rpcReq.ModuleName, rpcReq.MethodName).GetResponseCost(responseSize)
+	if cost <= 0 {
+		return status
+	}
+	scope, limit := rateLimitConfig.GetRateLimit(rpcReq.ModuleName, rpcReq.MethodName)
+
+	charged, err := server.rateLimiter.Charge(reqCtx.ClientID+"|"+scope, limit, cost)
+	if err != nil {
+		log.Errorln("error during rate limiting", reqCtx.ClientID, err)
+		return status
+	}
+	return charged
+}
+
+// handleCall either returns the cached response for a single JSON-RPC request or forwards the request
+// to egress and caches the response. Cache-Control directives of the user are taken into account
+func (server *Server) handleCall(data []byte, reqCtx *requestContext) *callResult {
+	rpcReq, err := egress.ParseCall(data)
+	if err != nil {
+		return newErrorResult(http.StatusBadRequest, egress.ParseRequestID(data), egress.GetParseErrorNum(err), err)
+	}
+	// Calls rejected by ingress are answered without going to egress
+	var rejection *callResult
+	if caller := reqCtx.Caller; caller != nil {
+		if !caller.isRPCMethodAllowed(rpcReq.ModuleName, rpcReq.MethodName) {
+			log.Infoln("Method is not allowed for the caller:", caller.Name, rpcReq.Method)
+			rejection = newErrorResult(http.StatusForbidden, rpcReq.ID, egress.RPCErrorForbidden)
+		} else {
+			rpcReq.Caller = caller.Name
+		}
+	}
+	// Invalid params are rejected here instead of being sent to jrpcserver
+	if rejection == nil {
+		if err := rpcReq.ValidateParams(server.config.JRPCServer.RPCMethodSchemas[rpcReq.GetFullMethodName()]); err != nil {
+			rejection = newErrorResult(http.StatusBadRequest, rpcReq.ID, egress.RPCErrorInvalidParams, err)
+		}
+	}
+	if rejection != nil && rpcReq.IsNotification {
+		rejection = &callResult{StatusCode: http.StatusNoContent}
+	}
+
+	// Cache hits may be exempt from rate limiting, in which case the call is only counted
+	// before going to egress. Rejected calls are counted as well, so that they can't be made
+	// without limits
+	var rateLimit *RateLimitStatus
+	exemptCacheHits := server.rateLimiter != nil && server.config.Ingress.RateLimit.ExemptCacheHits
+	if !exemptCacheHits || rpcReq.IsNotification || rejection != nil {
+		if rateLimit = server.takeRateLimit(rpcReq, reqCtx, len(data)); rateLimit != nil && !rateLimit.Allowed {
+			return newRateLimitedResult(rpcReq, rateLimit)
+		}
+	}
+	withRateLimit := func(result *callResult) *callResult {
+		result.RateLimit = rateLimit
+		return result
+	}
+	if rejection != nil {
+		return withRateLimit(rejection)
+	}
+
+	// Notifications are dispatched without waiting for the result and are never cached
+	if rpcReq.IsNotification {
+		if err := server.SendRPCNotification(rpcReq); err != nil {
+			log.Errorln("error during NATS notification", err)
+		}
+		return withRateLimit(&callResult{StatusCode: http.StatusNoContent})
+	}
+
+	directives := reqCtx.Directives
+	ingressConfig := server.config.Ingress
+	policy := ingressConfig.GetCachePolicy(rpcReq.ModuleName, rpcReq.MethodName)
+	if directives.NoStore {
+		policy.NoCache = true
+	}
+	refreshAfter := relayutil.GetDurationInSeconds(policy.RefreshCachedRequestThreshold)
+	// The user may accept responses which are older or require responses which are younger than usual
+	freshFor := refreshAfter
+	if directives.HasMaxAge {
+		freshFor = directives.MaxAge
+	}
 	reqKey := rpcReq.GetRequestKey()
-	if cachedRequest, ok := server.RequestCache.GetRequestByKey(reqKey); ok {
-		var skipRenewalCheck bool
-		// Check if request is expired
-		if cachedRequest.IsRequestStale(
-			relayutil.GetDurationInSeconds(server.config.Ingress.ExpireCachedRequestThreshold)) {
-			err := server.RequestCache.RemoveByKey(reqKey)
-			if err != nil {
-				log.Errorln("Failed to remove by key", reqKey, err)
-			}
-			skipRenewalCheck = true
-		}
-
-		// Check if request has to be renewed after the cached value is returned.
-		// Return request immediately if it's fresh enough.
-		//
-		// The assumption here is that a request older than some value but young enough not to be expired
-		// has to be renewed and the new result is returned afterwards.
-		// It is also possible to return the old result and then defer SendRPCRequest to renew the result
-		// after the user has already gotten their old result, but I assume this is not what was required.
-		if !skipRenewalCheck {
-			if !cachedRequest.IsRequestStale(
-				relayutil.GetDurationInSeconds(server.config.Ingress.RefreshCachedRequestThreshold)) {
-				log.Infoln("Returned cached request from cache:", reqKey)
-				w.Write(cachedRequest.Response)
-				return
+
+	var cachedRequest *CachedRequest
+	var isCached bool
+	if !policy.NoCache && !directives.NoCache {
+		cachedRequest, isCached = server.RequestCache.GetRequestByKey(reqKey)
+	}
+	if isCached {
+		age := time.Since(cachedRequest.CTime)
+		// Check if request is expired. Expired requests are kept for a while if they may be returned
+		// in case of an egress failure
+		if cachedRequest.IsRequestStale(relayutil.GetDurationInSeconds(policy.ExpireCachedRequestThreshold)) {
+			if cachedRequest.IsRequestStale(relayutil.GetDurationInSeconds(
+				policy.ExpireCachedRequestThreshold + ingressConfig.StaleIfErrorThreshold)) {
+				err := server.RequestCache.RemoveByKey(reqKey)
+				if err != nil {
+					log.Errorln("Failed to remove by key", reqKey, err)
+				}
+				isCached = false
 			}
+		} else if !cachedRequest.IsRequestStale(freshFor) {
+			// Return request immediately if it's fresh enough
+			log.Infoln("Returned cached request from cache:", reqKey)
+			return withRateLimit(
+				newResponseResult(rpcReq, cachedRequest.Response, newCacheInfo(CacheStatusHit, age, refreshAfter)))
+		} else if ingressConfig.StaleWhileRevalidate && !directives.HasMaxAge {
+			// A request older than the refresh threshold but young enough not to be expired has to be renewed.
+			// By default, the new result is returned after the renewal. In stale-while-revalidate mode,
+			// the old result is returned immediately and the renewal is done in the background
+			server.refreshInBackground(rpcReq, reqKey, policy)
+			log.Infoln("Returned stale request from cache:", reqKey)
+			return withRateLimit(
+				newResponseResult(rpcReq, cachedRequest.Response, newCacheInfo(CacheStatusStale, age, refreshAfter)))
 		}
 	}
 
-	msg, err := server.SendRPCRequest(rpcReq)
+	if exemptCacheHits {
+		if rateLimit = server.takeRateLimit(rpcReq, reqCtx, len(data)); rateLimit != nil && !rateLimit.Allowed {
+			return newRateLimitedResult(rpcReq, rateLimit)
+		}
+	}
+
+	rpcResp, err := server.fetchResponse(rpcReq, reqKey, policy)
 	if err != nil {
 		log.Errorln("error during NATS RPC call", err)
-		http.Error(w, "internal error", http.StatusInternalServerError)
+		if isCached && ingressConfig.StaleIfErrorThreshold > 0 {
+			log.Infoln("Returned stale request from cache after egress failure:", reqKey)
+			return withRateLimit(newResponseResult(rpcReq, cachedRequest.Response,
+				newCacheInfo(CacheStatusStale, time.Since(cachedRequest.CTime), refreshAfter)))
+		}
+		var egressErr *egressError
+		if errors.As(err, &egressErr) {
+			rateLimit = server.chargeRateLimit(rpcReq, reqCtx, rateLimit,
+				len(egressErr.Response.Result)+len(egressErr.Response.Error))
+			result := newResponseResult(rpcReq, egressErr.Response, nil)
+			result.StatusCode = getFailureHTTPStatus(err)
+			return withRateLimit(result)
+		}
+		return withRateLimit(newErrorResult(getFailureHTTPStatus(err), rpcReq.ID, egress.RPCErrorInternalError))
+	}
+
+	// Responses from egress may cost more than the call itself, their cost is known only now
+	responseSize := len(rpcResp.Result) + len(rpcResp.Error)
+	rateLimit = server.chargeRateLimit(rpcReq, reqCtx, rateLimit, responseSize)
+	info := newCacheInfo(CacheStatusMiss, 0, refreshAfter)
+	info.NoStore = !policy.IsCacheable(responseSize)
+	return withRateLimit(newResponseResult(rpcReq, rpcResp, info))
+}
+
+// handleBatchCall handles a single call of a batch. A panic only fails the call it happened in,
+// the rest of the batch is answered as usual
+func (server *Server) handleBatchCall(data []byte, reqCtx *requestContext) (result *callResult) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Errorln("Panic during batch call handling", r, string(debug.Stack()))
+			result = newErrorResult(http.StatusInternalServerError, egress.ParseRequestID(data), egress.RPCErrorInternalError)
+		}
+	}()
+
+	// Valid JSON which is not an object can't be a request
+	if !egress.IsObject(data) {
+		return newErrorResult(http.StatusBadRequest, nil, egress.RPCErrorInvalidRequest, "batch call is not an object")
+	}
+	return server.handleCall(data, reqCtx)
+}
+
+// handleBatch handles the requests in the batch concurrently, at most ingress.maxBatchConcurrency
+// at once, and returns the responses in the same order as the requests. Cached requests are served
+// from the cache, the rest are sent to egress
+func (server *Server) handleBatch(calls []json.RawMessage, reqCtx *requestContext) []*callResult {
+	results := make([]*callResult, len(calls))
+	numWorkers := server.config.Ingress.GetMaxBatchConcurrency()
+	if numWorkers > len(calls) {
+		numWorkers = len(calls)
+	}
+
+	indexes := make(chan int)
+	wg := sync.WaitGroup{}
+	wg.Add(numWorkers)
+	for worker := 0; worker < numWorkers; worker++ {
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				results[i] = server.handleBatchCall(calls[i], reqCtx)
+			}
+		}()
+	}
+	for i := range calls {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+	return results
+}
+
+func (server *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeHTTPError(w, http.StatusMethodNotAllowed, egress.RPCErrorInvalidRequest,
+			"invalid HTTP method: only POST is allowed")
 		return
 	}
 
-	var jsonResp map[string]any
+	// Responses to every call of the request, including cached ones, require a valid API key.
+	// Whether the caller may call the methods is checked for each call separately
+	var caller *rpcCaller
+	if server.auth != nil {
+		var err error
+		if caller, err = server.auth.authenticate(req); err != nil {
+			log.Infoln("Rejected request from", req.RemoteAddr, err)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="rpc-relay"`)
+			writeHTTPError(w, http.StatusUnauthorized, egress.RPCErrorUnauthorized)
+			return
+		}
+	}
 
-	err = json.Unmarshal(msg.Data, &jsonResp)
+	maxRequestBytes := server.config.Ingress.GetMaxRequestBytes()
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, maxRequestBytes))
+	// The body is cut at the limit if it is too large
+	if err != nil && int64(len(body)) >= maxRequestBytes {
+		writeHTTPError(w, http.StatusRequestEntityTooLarge, egress.RPCErrorInvalidRequest,
+			fmt.Sprintf("request body too large: at most %d bytes are allowed", maxRequestBytes))
+		return
+	}
 	if err != nil {
-		log.Errorln("error during NATS RPC call", err)
-		http.Error(w, "internal error", http.StatusInternalServerError)
+		log.Errorln("error during body reading", err)
+		server.writeResult(w, newErrorResult(http.StatusInternalServerError, nil, egress.RPCErrorInternalError))
 		return
 	}
 
-	respCode := http.StatusOK
+	reqCtx := &requestContext{Caller: caller, Directives: ParseCacheDirectives(req.Header)}
+	if server.rateLimiter != nil {
+		reqCtx.ClientID = server.getClientID(req, caller)
+	}
+	if !egress.IsBatch(body) {
+		server.writeResult(w, server.handleCall(body, reqCtx))
+		return
+	}
 
-	// Check if response is an ErrorResponse AND the error code is for an internal error.
-	// Return a http.Error with HTTP 500 in this case. Forward the error RPC response as usual otherwise
-	if errField, ok := jsonResp["error"]; ok {
-		if errField.(map[string]any)["code"] == egress.RPCErrorInternalError {
-			log.Errorln("error during NATS RPC call", jsonResp["error"])
-			http.Error(w, "internal error", http.StatusInternalServerError)
-			return
+	calls, err := egress.ParseBatch(body)
+	if err != nil {
+		server.writeResult(w, newErrorResult(http.StatusBadRequest, nil, egress.RPCErrorNotWellFormed, err))
+		return
+	}
+	// An empty batch is answered with a single error response as required by the spec
+	if len(calls) == 0 {
+		server.writeResult(w, newErrorResult(http.StatusBadRequest, nil, egress.RPCErrorInvalidRequest, "empty batch"))
+		return
+	}
+	if maxBatchSize := server.config.Ingress.GetMaxBatchSize(); len(calls) > maxBatchSize {
+		server.writeResult(w, newErrorResult(http.StatusBadRequest, nil, egress.RPCErrorInvalidRequest,
+			fmt.Sprintf("batch too large: at most %d calls are allowed", maxBatchSize)))
+		return
+	}
+
+	// Errors of separate calls are returned as a part of the batch response, so the status is always 200.
+	// Notifications are left out of the response
+	var batchResp bytes.Buffer
+	var numResponses int
+	batchResp.WriteByte('[')
+	for _, result := range server.handleBatch(calls, reqCtx) {
+		if result.Response == nil {
+			continue
 		}
-		respCode = http.StatusBadRequest
+		if numResponses > 0 {
+			batchResp.WriteByte(',')
+		}
+		batchResp.Write(result.Response)
+		numResponses++
+	}
+	batchResp.WriteByte(']')
+
+	// Nothing is returned if the batch consisted of notifications only
+	if numResponses == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
 	}
 
-	defer server.RequestCache.Add(rpcReq, msg.Data)
-	log.Infoln("Added request to cache:", reqKey)
-	w.WriteHeader(respCode)
-	w.Write(msg.Data)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(batchResp.Bytes())
 }
 
 // NewServer creates a new ingress server and initializes the NATS connection
@@ -136,12 +548,32 @@ func NewServer(config *relayutil.Config) (*Server, error) {
 		return nil, err
 	}
 
+	var auth *authenticator
+	if config.Ingress.Auth != nil {
+		if auth, err = newAuthenticator(config.Ingress.Auth); err != nil {
+			nc.Close()
+			return nil, err
+		}
+	}
+
+	var rateLimiter RateLimiter
+	if config.Ingress.RateLimit != nil {
+		if rateLimiter, err = NewRateLimiter(config.Ingress.RateLimit, nc); err != nil {
+			nc.Close()
+			return nil, err
+		}
+	}
+
 	done := make(chan bool)
 
-	reqCache := NewRequestCache(config)
+	reqCache, err := NewCache(config, nc)
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
 	reqCache.Start()
 
-	server := &Server{reqCache, nc, done, &wg, config}
+	server := &Server{reqCache, newCallGroup(), nc, done, &wg, auth, rateLimiter, config}
 
 	return server, nil
 }
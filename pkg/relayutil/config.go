@@ -3,6 +3,7 @@ package relayutil
 import (
 	"encoding/json"
 	"fmt"
+	"math"
 	"os"
 	"strings"
 	"time"
@@ -10,11 +11,100 @@ import (
 
 // JRPCServerConfig is a part of the config which holds config values for the JSONRPC server
 type JRPCServerConfig struct {
-	Host              string
-	Port              int
-	RPCEndpointURL    string
+	Host           string
+	Port           int
+	RPCEndpointURL string
+	// Enabled RPC methods keyed by module name. "*" enables all methods of a module
 	EnabledRPCModules map[string][]string
-	IsTLSEnabled      bool
+	// RPC methods which can't be called even if they are enabled, keyed by module name. "*" disables
+	// all methods of a module
+	DisabledRPCMethods map[string][]string
+	IsTLSEnabled       bool
+	// Parameter schemas of RPC methods keyed by the full method name ("calculateSum_calculateSum")
+	RPCMethodSchemas map[string]*RPCMethodSchema
+
+	// Sets built from EnabledRPCModules and DisabledRPCMethods
+	enabledRPCMethods  map[string]rpcMethodSet
+	disabledRPCMethods map[string]rpcMethodSet
+}
+
+// RPCMethodWildcard matches every method of a module in method lists
+const RPCMethodWildcard string = "*"
+
+// rpcMethodSet is a set of RPC method names of a module
+type rpcMethodSet map[string]struct{}
+
+// newRPCMethodSets converts method lists into sets
+func newRPCMethodSets(methodLists map[string][]string) map[string]rpcMethodSet {
+	sets := make(map[string]rpcMethodSet, len(methodLists))
+	for moduleName, methods := range methodLists {
+		set := make(rpcMethodSet, len(methods))
+		for _, method := range methods {
+			set[method] = struct{}{}
+		}
+		sets[moduleName] = set
+	}
+	return sets
+}
+
+// contains checks whether the method or the wildcard is in the set
+func (set rpcMethodSet) contains(methodName string) bool {
+	_, ok := set[methodName]
+	_, all := set[RPCMethodWildcard]
+	return ok || all
+}
+
+// BuildRPCMethodSets converts the enabled and disabled method lists into sets used by IsRPCMethodEnabled.
+// Has to be called again if the lists are changed
+func (config *JRPCServerConfig) BuildRPCMethodSets() {
+	config.enabledRPCMethods = newRPCMethodSets(config.EnabledRPCModules)
+	config.disabledRPCMethods = newRPCMethodSets(config.DisabledRPCMethods)
+}
+
+// IsRPCModuleEnabled checks whether the module is exposed
+func (config *JRPCServerConfig) IsRPCModuleEnabled(moduleName string) bool {
+	_, ok := config.EnabledRPCModules[moduleName]
+	return ok
+}
+
+// IsRPCMethodEnabled checks whether the method is enabled and not disabled for the module
+func (config *JRPCServerConfig) IsRPCMethodEnabled(moduleName, methodName string) bool {
+	return config.enabledRPCMethods[moduleName].contains(methodName) &&
+		!config.disabledRPCMethods[moduleName].contains(methodName)
+}
+
+// RPCMethodSchema describes the parameters of an RPC method
+type RPCMethodSchema struct {
+	// Parameters in positional order. Named params are mapped to positions by their names
+	Params []*RPCParamSchema
+}
+
+// RPCParamSchema describes a single parameter of an RPC method
+type RPCParamSchema struct {
+	Name string
+	// JSON type of the parameter: "number", "integer", "string", "boolean", "array" or "object".
+	// Any type is accepted if empty
+	Type string
+	// Optional parameters may be omitted or null
+	Optional bool
+	// Inclusive range of number parameters
+	Minimum *float64
+	Maximum *float64
+	// Length limits of string parameters, in characters
+	MinLength *int
+	MaxLength *int
+	// Allowed values of the parameter
+	Enum []any
+}
+
+// GetParamIndex returns the position of the parameter with the given name, or -1 if there is none
+func (schema *RPCMethodSchema) GetParamIndex(name string) int {
+	for i, param := range schema.Params {
+		if param.Name == name {
+			return i
+		}
+	}
+	return -1
 }
 
 // GetFullEndpointURL generates a full HTTP URL for JSON-RPC endpoint from the config
@@ -47,6 +137,439 @@ type IngressConfig struct {
 	NATSCallWaitTimeout float64
 	// Run cache invalidation each N seconds
 	InvalidateCacheLoopSleepPeriod float64
+	// If enabled, a cached request which has to be refreshed (see RefreshCachedRequestThreshold) is returned
+	// immediately, and the refresh is done in the background
+	StaleWhileRevalidate bool
+	// Threshold value in seconds. Expired cached requests are kept for this long after expiration and are
+	// returned if egress fails or times out. Disabled if zero
+	StaleIfErrorThreshold float64
+	// Maximum number of cached requests. The least recently used requests are evicted once the limit is reached.
+	// Unlimited if zero
+	MaxCacheEntries int
+	// Maximum total size of cached requests and responses in bytes. The least recently used requests are evicted
+	// once the limit is reached. Unlimited if zero
+	MaxCacheBytes int
+	// Storage used for cached requests: "memory" (default), "redis" or "nats"
+	CacheBackend string
+	// Redis connection settings, used by the "redis" cache backend
+	Redis *RedisConfig
+	// JetStream key-value bucket settings, used by the "nats" cache backend
+	NATSKeyValue *NATSKeyValueConfig
+	// Cache policies for RPC modules ("calculateSum") or methods ("calculateSum_calculateSum")
+	CachePolicies map[string]*CachePolicy
+	// HTTP statuses of single-request responses: "rest" (default) maps the outcome of the call to the status,
+	// "jsonrpc" returns 200 for every JSON-RPC response
+	HTTPStatusMode string
+	// HTTP statuses of error responses keyed by the JSON-RPC error code. Override the default mapping
+	// in the "rest" status mode
+	HTTPStatusCodes map[int]int
+	// API key authentication settings. Authentication is disabled if nil
+	Auth *AuthConfig
+	// Rate limiting settings. Rate limiting is disabled if nil
+	RateLimit *RateLimitConfig
+	// Maximum size of the request body in bytes. Defaults to DefaultMaxRequestBytes
+	MaxRequestBytes int64
+	// Maximum number of calls in a batch, larger batches are rejected. Defaults to DefaultMaxBatchSize
+	MaxBatchSize int
+	// Maximum number of calls of a batch handled at once. Defaults to DefaultMaxBatchConcurrency
+	MaxBatchConcurrency int
+}
+
+// Default request limits of IngressConfig
+const (
+	DefaultMaxRequestBytes     int64 = 1 << 20
+	DefaultMaxBatchSize        int   = 100
+	DefaultMaxBatchConcurrency int   = 10
+)
+
+// GetMaxRequestBytes returns the maximum size of the request body in bytes
+func (config *IngressConfig) GetMaxRequestBytes() int64 {
+	if config.MaxRequestBytes <= 0 {
+		return DefaultMaxRequestBytes
+	}
+	return config.MaxRequestBytes
+}
+
+// GetMaxBatchSize returns the maximum number of calls in a batch
+func (config *IngressConfig) GetMaxBatchSize() int {
+	if config.MaxBatchSize <= 0 {
+		return DefaultMaxBatchSize
+	}
+	return config.MaxBatchSize
+}
+
+// GetMaxBatchConcurrency returns the maximum number of calls of a batch handled at once
+func (config *IngressConfig) GetMaxBatchConcurrency() int {
+	if config.MaxBatchConcurrency <= 0 {
+		return DefaultMaxBatchConcurrency
+	}
+	return config.MaxBatchConcurrency
+}
+
+// Values of IngressConfig.HTTPStatusMode
+const (
+	HTTPStatusModeREST    string = "rest"
+	HTTPStatusModeJSONRPC string = "jsonrpc"
+)
+
+// CachePolicy holds the cache settings for an RPC module or method. Zero thresholds fall back to the
+// global ingress config values
+type CachePolicy struct {
+	RefreshCachedRequestThreshold float64
+	ExpireCachedRequestThreshold  float64
+	// If set, responses are never cached and identical calls are not coalesced
+	NoCache bool
+	// Maximum size of a cacheable response in bytes. Unlimited if zero
+	MaxResponseSize int
+}
+
+// IsCacheable checks if a response of the given size can be cached according to the policy
+func (policy *CachePolicy) IsCacheable(responseSize int) bool {
+	return !policy.NoCache && (policy.MaxResponseSize == 0 || responseSize <= policy.MaxResponseSize)
+}
+
+// GetCachePolicy returns the cache policy for the RPC method. The policy for the full method name takes
+// precedence over the policy for the module. Global thresholds are used if there is no policy
+func (config *IngressConfig) GetCachePolicy(moduleName, methodName string) *CachePolicy {
+	var policy CachePolicy
+	if methodPolicy, ok := config.CachePolicies[moduleName+"_"+methodName]; ok {
+		policy = *methodPolicy
+	} else if modulePolicy, ok := config.CachePolicies[moduleName]; ok {
+		policy = *modulePolicy
+	}
+
+	if policy.RefreshCachedRequestThreshold == 0 {
+		policy.RefreshCachedRequestThreshold = config.RefreshCachedRequestThreshold
+	}
+	if policy.ExpireCachedRequestThreshold == 0 {
+		policy.ExpireCachedRequestThreshold = config.ExpireCachedRequestThreshold
+	}
+	return &policy
+}
+
+// GetMaxExpireCachedRequestThreshold returns the longest expiration threshold among the global one and
+// the cache policies
+func (config *IngressConfig) GetMaxExpireCachedRequestThreshold() float64 {
+	maxThreshold := config.ExpireCachedRequestThreshold
+	for _, policy := range config.CachePolicies {
+		if policy.ExpireCachedRequestThreshold > maxThreshold {
+			maxThreshold = policy.ExpireCachedRequestThreshold
+		}
+	}
+	return maxThreshold
+}
+
+// RateLimitConfig is a part of the ingress config which holds the rate limiting settings. Each call is
+// counted separately, including the calls of a batch
+type RateLimitConfig struct {
+	// Client identity the limits apply to: "caller" (default) uses the authenticated caller name and falls
+	// back to the IP address, "ip" uses the IP address and "header" uses the value of ClientHeader
+	ClientKey string
+	// Header holding the client identity, used with the "header" client key. The IP address is used
+	// if the header is missing
+	ClientHeader string
+	// Limit for the calls without a policy. Unlimited if nil
+	Default *RateLimit
+	// Limits for RPC modules ("calculateSum") or methods ("calculateSum_calculateSum"). The method limit
+	// takes precedence over the module limit. Calls to the methods of a module share the module limit
+	Policies map[string]*RateLimit
+	// Costs of the calls to RPC modules or methods, keyed like Policies. Calls cost 1 token if there is
+	// no cost for the method
+	Costs map[string]*RPCMethodCost
+	// If set, calls served from the cache are not counted
+	ExemptCacheHits bool
+	// Storage of the buckets: "memory" (default) counts the calls of each ingress replica separately,
+	// "nats" shares the buckets between replicas through a JetStream key-value bucket
+	Backend string
+	// JetStream key-value bucket settings, used by the "nats" backend
+	NATSKeyValue *NATSKeyValueConfig
+}
+
+// Values of RateLimitConfig.ClientKey
+const (
+	RateLimitClientKeyCaller string = "caller"
+	RateLimitClientKeyIP     string = "ip"
+	RateLimitClientKeyHeader string = "header"
+)
+
+// RateLimit is a token bucket limit with an optional daily quota
+type RateLimit struct {
+	// Tokens added to the bucket per second. Only the quota applies if zero
+	Rate float64
+	// Bucket size, i.e. the number of calls which can be made at once. Defaults to the rate rounded up,
+	// but at least 1
+	Burst int
+	// Maximum number of tokens taken per day, i.e. the number of calls if they cost 1 token, reset at
+	// midnight UTC. Unlimited if zero
+	DailyQuota int
+}
+
+// RPCMethodCost is the number of tokens a call takes from the bucket of the client
+type RPCMethodCost struct {
+	// Tokens taken by every call. Defaults to 1 if zero
+	Base float64
+	// Tokens taken per KiB of the JSON-RPC request, i.e. mostly of the params
+	PerRequestKiB float64
+	// Tokens taken per KiB of the response received from egress. They are taken after the call,
+	// so the bucket may go into debt. Responses served from the cache are not charged
+	PerResponseKiB float64
+}
+
+// GetCallCost returns the number of tokens taken before the call with the request of the given size
+func (cost *RPCMethodCost) GetCallCost(requestSize int) float64 {
+	if cost == nil {
+		return 1
+	}
+	base := cost.Base
+	if base == 0 {
+		base = 1
+	}
+	return base + cost.PerRequestKiB*float64(requestSize)/1024
+}
+
+// GetResponseCost returns the number of tokens taken after the call for the response of the given size
+func (cost *RPCMethodCost) GetResponseCost(responseSize int) float64 {
+	if cost == nil {
+		return 0
+	}
+	return cost.PerResponseKiB * float64(responseSize) / 1024
+}
+
+// GetRPCMethodCost returns the cost of the calls to the RPC method. The cost for the full method name takes
+// precedence over the cost for the module. Nil if the calls cost 1 token
+func (config *RateLimitConfig) GetRPCMethodCost(moduleName, methodName string) *RPCMethodCost {
+	if cost, ok := config.Costs[moduleName+"_"+methodName]; ok {
+		return cost
+	}
+	return config.Costs[moduleName]
+}
+
+// GetBurst returns the bucket size of the limit
+func (limit *RateLimit) GetBurst() int {
+	if limit.Burst > 0 {
+		return limit.Burst
+	}
+	return int(math.Max(1, math.Ceil(limit.Rate)))
+}
+
+// GetMaxIdlePeriod returns the longest time a bucket takes to get back to its initial state: a day for
+// the quotas or the time the slowest bucket takes to refill
+func (config *RateLimitConfig) GetMaxIdlePeriod() time.Duration {
+	maxPeriod := 24 * time.Hour
+	limits := []*RateLimit{config.Default}
+	for _, limit := range config.Policies {
+		limits = append(limits, limit)
+	}
+	for _, limit := range limits {
+		if limit == nil || limit.Rate <= 0 {
+			continue
+		}
+		if period := GetDurationInSeconds(float64(limit.GetBurst()) / limit.Rate); period > maxPeriod {
+			maxPeriod = period
+		}
+	}
+	return maxPeriod
+}
+
+// GetRateLimit returns the limit for the RPC method and the scope it is counted in: the full method name,
+// the module name or an empty string for the default limit. The limit is nil if the calls are not limited
+func (config *RateLimitConfig) GetRateLimit(moduleName, methodName string) (string, *RateLimit) {
+	if limit, ok := config.Policies[moduleName+"_"+methodName]; ok {
+		return moduleName + "_" + methodName, limit
+	}
+	if limit, ok := config.Policies[moduleName]; ok {
+		return moduleName, limit
+	}
+	return "", config.Default
+}
+
+// AuthConfig is a part of the ingress config which holds the API key authentication settings
+type AuthConfig struct {
+	// Header carrying the API key. Keys are also accepted as bearer tokens in the Authorization header.
+	// Defaults to "X-API-Key"
+	APIKeyHeader string
+	// API keys of the callers
+	APIKeys []*APIKey
+	// Path to a JSON file with a list of API keys, loaded in addition to APIKeys
+	APIKeysFile string
+	// JWT bearer token validation settings. Only API keys are accepted if nil
+	JWT *JWTConfig
+}
+
+// DefaultAPIKeyHeader is the default value of AuthConfig.APIKeyHeader
+const DefaultAPIKeyHeader string = "X-API-Key"
+
+// APIKey holds an API key and the RPC methods its caller may call
+type APIKey struct {
+	// Name of the caller, used for logging by ingress and egress
+	Name string
+	Key  string
+	// Allowed RPC methods keyed by module name. "*" allows all methods of a module or all modules.
+	// Nothing is allowed if empty. Methods still have to be enabled in the jrpcserver config
+	AllowedRPCMethods map[string][]string
+
+	// Set built from AllowedRPCMethods
+	allowedRPCMethods map[string]rpcMethodSet
+}
+
+// isRPCMethodAllowed checks whether the method is in the sets of allowed methods. The wildcard module
+// allows methods of all modules
+func isRPCMethodAllowed(allowedRPCMethods map[string]rpcMethodSet, moduleName, methodName string) bool {
+	return allowedRPCMethods[moduleName].contains(methodName) ||
+		allowedRPCMethods[RPCMethodWildcard].contains(methodName)
+}
+
+// IsRPCMethodAllowed checks whether the caller may call the method
+func (key *APIKey) IsRPCMethodAllowed(moduleName, methodName string) bool {
+	return isRPCMethodAllowed(key.allowedRPCMethods, moduleName, methodName)
+}
+
+// LoadAPIKeys returns the API keys from the config and the keys file. Every key has to have
+// a unique name and a unique non-empty value
+func (config *AuthConfig) LoadAPIKeys() ([]*APIKey, error) {
+	keys := append([]*APIKey{}, config.APIKeys...)
+	if config.APIKeysFile != "" {
+		data, err := os.ReadFile(config.APIKeysFile)
+		if err != nil {
+			return nil, err
+		}
+		var fileKeys []*APIKey
+		if err := json.Unmarshal(data, &fileKeys); err != nil {
+			return nil, fmt.Errorf("invalid API keys file %v: %w", config.APIKeysFile, err)
+		}
+		keys = append(keys, fileKeys...)
+	}
+
+	names := make(map[string]struct{}, len(keys))
+	values := make(map[string]struct{}, len(keys))
+	for _, key := range keys {
+		if key.Name == "" || key.Key == "" {
+			return nil, fmt.Errorf("API key without a name or a value")
+		}
+		if _, ok := names[key.Name]; ok {
+			return nil, fmt.Errorf("duplicate API key name %q", key.Name)
+		}
+		if _, ok := values[key.Key]; ok {
+			return nil, fmt.Errorf("duplicate API key value for %q", key.Name)
+		}
+		names[key.Name] = struct{}{}
+		values[key.Key] = struct{}{}
+		key.allowedRPCMethods = newRPCMethodSets(key.AllowedRPCMethods)
+	}
+	return keys, nil
+}
+
+// JWTConfig is a part of the auth config which holds the JWT bearer token validation settings
+type JWTConfig struct {
+	// Path to a JWKS file with the keys the tokens are signed with
+	JWKSFile string
+	// URL of a JWKS endpoint, used if JWKSFile is not set. The keys are fetched again once they
+	// are older than JWKSRefreshPeriod or a token is signed with an unknown key
+	JWKSURL string
+	// Threshold value in seconds. Defaults to 300
+	JWKSRefreshPeriod float64
+	// Required "iss" claim. Not checked if empty
+	Issuer string
+	// Required "aud" claim value. Not checked if empty
+	Audience string
+	// Allowed clock difference in seconds when checking the "exp" and "nbf" claims
+	ClockSkew float64
+	// Claim holding the name of the caller. Defaults to "sub"
+	NameClaim string
+	// Policies granting RPC methods to the tokens. A token may call the methods of all matching policies
+	ClaimPolicies []*JWTClaimPolicy
+}
+
+// Default values of JWTConfig
+const (
+	DefaultJWKSRefreshPeriod float64 = 300
+	DefaultJWTNameClaim      string  = "sub"
+)
+
+// JWTClaimPolicy grants RPC methods to the tokens with the given claim value
+type JWTClaimPolicy struct {
+	// Claim name, e.g. "scope" or "groups"
+	Claim string
+	// Claim value. Array claims and space-separated string claims (such as "scope") match if they contain
+	// the value
+	Value string
+	// Allowed RPC methods keyed by module name, in the same format as APIKey.AllowedRPCMethods
+	AllowedRPCMethods map[string][]string
+
+	// Set built from AllowedRPCMethods
+	allowedRPCMethods map[string]rpcMethodSet
+}
+
+// IsRPCMethodAllowed checks whether the policy allows calling the method
+func (policy *JWTClaimPolicy) IsRPCMethodAllowed(moduleName, methodName string) bool {
+	return isRPCMethodAllowed(policy.allowedRPCMethods, moduleName, methodName)
+}
+
+// Matches checks whether the claim of the token has the value of the policy
+func (policy *JWTClaimPolicy) Matches(claims map[string]any) bool {
+	switch claim := claims[policy.Claim].(type) {
+	case string:
+		if claim == policy.Value {
+			return true
+		}
+		for _, value := range strings.Fields(claim) {
+			if value == policy.Value {
+				return true
+			}
+		}
+	case []any:
+		for _, value := range claim {
+			if fmt.Sprint(value) == policy.Value {
+				return true
+			}
+		}
+	case nil:
+	default:
+		return fmt.Sprint(claim) == policy.Value
+	}
+	return false
+}
+
+// Init checks the config, fills in the default values and builds the sets of allowed methods.
+// Has to be called again if the policies are changed
+func (config *JWTConfig) Init() error {
+	if config.JWKSFile == "" && config.JWKSURL == "" {
+		return fmt.Errorf("either a JWKS file or a JWKS URL is required")
+	}
+	if config.JWKSRefreshPeriod == 0 {
+		config.JWKSRefreshPeriod = DefaultJWKSRefreshPeriod
+	}
+	if config.NameClaim == "" {
+		config.NameClaim = DefaultJWTNameClaim
+	}
+	for _, policy := range config.ClaimPolicies {
+		if policy.Claim == "" {
+			return fmt.Errorf("JWT claim policy without a claim")
+		}
+		policy.allowedRPCMethods = newRPCMethodSets(policy.AllowedRPCMethods)
+	}
+	return nil
+}
+
+// NATSKeyValueConfig is a part of the ingress config which holds the settings for the JetStream
+// key-value bucket
+type NATSKeyValueConfig struct {
+	// Bucket name. The bucket is created if it does not exist
+	BucketName string
+	// Number of bucket replicas in a NATS cluster
+	Replicas int
+	// Maximum size of the bucket in bytes. Unlimited if zero
+	MaxBytes int64
+}
+
+// RedisConfig is a part of the ingress config which holds the Redis connection settings
+type RedisConfig struct {
+	// host:port address of the Redis server
+	Address  string
+	Password string
+	DB       int
+	// Prefix added to the request keys, allows sharing the Redis database with other applications
+	KeyPrefix string
 }
 
 // GetHostWithPort Returns a host:port for the ingress server
@@ -58,8 +581,19 @@ func (config *IngressConfig) GetHostWithPort() string {
 type EgressConfig struct {
 	Host string
 	Port int
+	// Redaction of internal errors returned by jrpcserver (internal error and server error codes):
+	// "full" (default) replaces the message with the standard one and drops the data, "data" drops the data,
+	// "none" forwards the errors as they are. Other errors are always forwarded as they are
+	InternalErrorRedaction string
 }
 
+// Values of EgressConfig.InternalErrorRedaction
+const (
+	ErrorRedactionFull string = "full"
+	ErrorRedactionData string = "data"
+	ErrorRedactionNone string = "none"
+)
+
 // NATSConfig is a part of the config which holds config values for the NATS server
 type NATSConfig struct {
 	ServerURL   string
@@ -100,6 +634,9 @@ func (config *Config) Parse(configPath string) error {
 	if err != nil {
 		return err
 	}
+	if config.JRPCServer != nil {
+		config.JRPCServer.BuildRPCMethodSets()
+	}
 
 	return nil
 }
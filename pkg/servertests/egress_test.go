@@ -7,6 +7,7 @@ import (
 	"github.com/parkanaur/rpc-relay/pkg/relayutil"
 	"github.com/stretchr/testify/assert"
 	"testing"
+	"time"
 )
 
 type RPCCalcSumResponse struct {
@@ -53,11 +54,178 @@ func TestEgress_Server_handleRPCRequest(t *testing.T) {
 		[]byte(`{"jsonrpc": "2.0", "id": 1, "method": "calculateSum_calculateSum", "params": [1, 2]}`),
 		relayutil.GetDurationInSeconds(cf.Ingress.NATSCallWaitTimeout))
 
+	reply, err := egress.ParseEgressReply(rq.Data)
+	assert.NoError(t, err)
+	assert.Equal(t, egress.ReplyStatusOK, reply.Status)
+	assert.Greater(t, reply.BackendDuration, time.Duration(0))
+
 	expected := RPCCalcSumResponse{JSONRPC: "2.0", Result: 3, ID: 1}
 	var actual RPCCalcSumResponse
-	err = json.Unmarshal(rq.Data, &actual)
+	err = json.Unmarshal(reply.Response, &actual)
 	if err != nil {
 		t.Fatal(err)
 	}
 	assert.Equal(t, expected, actual)
 }
+
+func TestJRPCServerConfig_IsRPCMethodEnabled(t *testing.T) {
+	cf := &relayutil.JRPCServerConfig{
+		EnabledRPCModules: map[string][]string{
+			"calculateSum":  {"calculateSum"},
+			"reverseString": {relayutil.RPCMethodWildcard},
+			"internal":      {relayutil.RPCMethodWildcard},
+		},
+		DisabledRPCMethods: map[string][]string{
+			"reverseString": {"debug"},
+			"internal":      {relayutil.RPCMethodWildcard},
+		},
+	}
+	cf.BuildRPCMethodSets()
+
+	assert.True(t, cf.IsRPCMethodEnabled("calculateSum", "calculateSum"))
+	assert.False(t, cf.IsRPCMethodEnabled("calculateSum", "helper"))
+	assert.True(t, cf.IsRPCMethodEnabled("reverseString", "reverseString"))
+	assert.False(t, cf.IsRPCMethodEnabled("reverseString", "debug"))
+	assert.False(t, cf.IsRPCMethodEnabled("internal", "reverseString"))
+	assert.False(t, cf.IsRPCMethodEnabled("unknown", "unknown"))
+	assert.True(t, cf.IsRPCModuleEnabled("internal"))
+	assert.False(t, cf.IsRPCModuleEnabled("unknown"))
+}
+
+func TestEgress_Server_handleDisabledMethods(t *testing.T) {
+	cases := []struct {
+		enabled  []string
+		disabled []string
+	}{
+		{enabled: []string{"helper"}},
+		{enabled: []string{relayutil.RPCMethodWildcard}, disabled: []string{"calculateSum"}},
+		{enabled: []string{"calculateSum"}, disabled: []string{relayutil.RPCMethodWildcard}},
+	}
+	for _, c := range cases {
+		cf := NewTestConfig()
+		cf.JRPCServer.EnabledRPCModules["calculateSum"] = c.enabled
+		cf.JRPCServer.DisabledRPCMethods = map[string][]string{"calculateSum": c.disabled}
+		fixture := NewRelayFixture(t, cf)
+
+		rq, err := fixture.EgressServer.NATSConnection.Request(
+			"rpc.calculateSum.calculateSum",
+			[]byte(`{"jsonrpc": "2.0", "id": 1, "method": "calculateSum_calculateSum", "params": [1, 2]}`),
+			relayutil.GetDurationInSeconds(cf.Ingress.NATSCallWaitTimeout))
+		assert.NoError(t, err)
+
+		reply, err := egress.ParseEgressReply(rq.Data)
+		assert.NoError(t, err)
+		assert.Equal(t, egress.ReplyStatusRelayError, reply.Status)
+		assert.Equal(t, egress.RelayErrorRejected, reply.ErrorClass)
+		var actual egress.RPCErrorResponse
+		assert.NoError(t, json.Unmarshal(reply.Response, &actual))
+		assert.Equal(t, egress.RPCErrorNum(egress.RPCErrorMethodNotEnabled), actual.Error.Code)
+		fixture.Shutdown()
+	}
+}
+
+// collectEgressReplies sends the request to egress and returns all the replies which arrive for it
+func collectEgressReplies(t *testing.T, cf *relayutil.Config, subject string, data string) []*egress.EgressReply {
+	nc, err := nats.Connect(cf.NATS.ServerURL)
+	assert.NoError(t, err)
+	defer nc.Close()
+
+	inbox := nats.NewInbox()
+	sub, err := nc.SubscribeSync(inbox)
+	assert.NoError(t, err)
+	assert.NoError(t, nc.PublishRequest(subject, inbox, []byte(data)))
+
+	var replies []*egress.EgressReply
+	// Waiting for the first reply for as long as ingress would, then for a while for any duplicates
+	wait := relayutil.GetDurationInSeconds(cf.Ingress.NATSCallWaitTimeout)
+	for {
+		msg, err := sub.NextMsg(wait)
+		if err != nil {
+			return replies
+		}
+		reply, err := egress.ParseEgressReply(msg.Data)
+		assert.NoError(t, err)
+		replies = append(replies, reply)
+		wait = 200 * time.Millisecond
+	}
+}
+
+func TestEgress_Server_handleRPCRequestRepliesOnce(t *testing.T) {
+	cf := NewTestConfig()
+	cf.JRPCServer.EnabledRPCModules[NullServiceName] = []string{"nothing", "null", "missing", "broken"}
+	// A schema with a missing param makes the handling of named params panic
+	cf.JRPCServer.RPCMethodSchemas["null_broken"] = &relayutil.RPCMethodSchema{Params: []*relayutil.RPCParamSchema{nil}}
+	fixture := NewRelayFixture(t, cf)
+	defer fixture.Shutdown()
+
+	cases := []struct {
+		subject string
+		data    string
+		status  egress.ReplyStatus
+		want    string
+	}{
+		{"rpc.calculateSum.calculateSum", `{bad`, egress.ReplyStatusRelayError,
+			`{"jsonrpc":"2.0","id":null,"error":{"code":-32700,"message":"not well formed"}}`},
+		{"rpc.reverseString.reverseString", `{"jsonrpc": "2.0", "id": 1, "method": "reverseString_reverseString", "params": ["a"]}`, egress.ReplyStatusRelayError,
+			`{"jsonrpc":"2.0","id":1,"error":{"code":101,"message":"module not enabled"}}`},
+		{"rpc.calculateSum.other", `{"jsonrpc": "2.0", "id": 1, "method": "calculateSum_other", "params": []}`, egress.ReplyStatusRelayError,
+			`{"jsonrpc":"2.0","id":1,"error":{"code":102,"message":"method not enabled"}}`},
+		{"rpc.calculateSum.calculateSum", `{"jsonrpc": "2.0", "id": 1, "method": "calculateSum_calculateSum", "params": {"c": 1}}`, egress.ReplyStatusRelayError,
+			`{"jsonrpc":"2.0","id":1,"error":{"code":-32602,"message":"invalid params"}}`},
+		{"rpc.calculateSum.calculateSum", `{"jsonrpc": "2.0", "id": 1, "method": "calculateSum_calculateSum", "params": ["a", "b"]}`, egress.ReplyStatusBackendError,
+			`{"jsonrpc":"2.0","id":1,"error":{"code":-32602,"message":"invalid argument 0: json: cannot unmarshal string into Go value of type float64"}}`},
+		{"rpc.null.missing", `{"jsonrpc": "2.0", "id": 1, "method": "null_missing", "params": []}`, egress.ReplyStatusBackendError,
+			`{"jsonrpc":"2.0","id":1,"error":{"code":-32601,"message":"the method null_missing does not exist/is not available"}}`},
+		{"rpc.null.nothing", `{"jsonrpc": "2.0", "id": 1, "method": "null_nothing", "params": []}`, egress.ReplyStatusOK,
+			`{"jsonrpc":"2.0","result":null,"id":1}`},
+		{"rpc.null.null", `{"jsonrpc": "2.0", "id": 1, "method": "null_null", "params": []}`, egress.ReplyStatusOK,
+			`{"jsonrpc":"2.0","result":null,"id":1}`},
+		{"rpc.null.broken", `{"jsonrpc": "2.0", "id": 1, "method": "null_broken", "params": {"a": 1}}`, egress.ReplyStatusRelayError,
+			`{"jsonrpc":"2.0","id":1,"error":{"code":-32603,"message":"internal error"}}`},
+		{"rpc.calculateSum.calculateSum", `{"jsonrpc": "2.0", "id": 1, "method": "calculateSum_calculateSum", "params": [1, 2]}`, egress.ReplyStatusOK,
+			`{"jsonrpc":"2.0","result":3,"id":1}`},
+	}
+	for _, c := range cases {
+		replies := collectEgressReplies(t, cf, c.subject, c.data)
+		if assert.Len(t, replies, 1, c.data) {
+			assert.Equal(t, c.status, replies[0].Status, c.data)
+			assert.JSONEq(t, c.want, string(replies[0].Response), c.data)
+		}
+	}
+}
+
+func TestEgress_Server_handleBackendErrors(t *testing.T) {
+	cases := []struct {
+		redaction string
+		method    string
+		want      string
+	}{
+		// Application errors are forwarded as they are
+		{"", "error_fail",
+			`{"jsonrpc":"2.0","id":1,"error":{"code":3,"message":"application error","data":{"reason":"test"}}}`},
+		{"", "error_crash",
+			`{"jsonrpc":"2.0","id":1,"error":{"code":-32603,"message":"internal error"}}`},
+		{relayutil.ErrorRedactionFull, "error_plain",
+			`{"jsonrpc":"2.0","id":1,"error":{"code":-32000,"message":"server error"}}`},
+		{relayutil.ErrorRedactionData, "error_crash",
+			`{"jsonrpc":"2.0","id":1,"error":{"code":-32603,"message":"crash"}}`},
+		{relayutil.ErrorRedactionNone, "error_crash",
+			`{"jsonrpc":"2.0","id":1,"error":{"code":-32603,"message":"crash","data":"stack trace"}}`},
+		{relayutil.ErrorRedactionNone, "error_plain",
+			`{"jsonrpc":"2.0","id":1,"error":{"code":-32000,"message":"secret detail"}}`},
+	}
+	for _, c := range cases {
+		cf := NewTestConfig()
+		cf.JRPCServer.EnabledRPCModules[ErrorServiceName] = []string{relayutil.RPCMethodWildcard}
+		cf.Egress.InternalErrorRedaction = c.redaction
+		fixture := NewRelayFixture(t, cf)
+
+		replies := collectEgressReplies(t, cf, "rpc.error.any",
+			`{"jsonrpc": "2.0", "id": 1, "method": "`+c.method+`", "params": []}`)
+		if assert.Len(t, replies, 1, c.method) {
+			assert.Equal(t, egress.ReplyStatusBackendError, replies[0].Status)
+			assert.JSONEq(t, c.want, string(replies[0].Response), c.redaction+" "+c.method)
+		}
+		fixture.Shutdown()
+	}
+}
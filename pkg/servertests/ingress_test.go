@@ -3,12 +3,22 @@ package servertests
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"github.com/nats-io/nats.go"
 	"github.com/parkanaur/rpc-relay/pkg/egress"
 	"github.com/parkanaur/rpc-relay/pkg/ingress"
+	"github.com/parkanaur/rpc-relay/pkg/relayutil"
 	"github.com/stretchr/testify/assert"
+	"io"
 	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestIngress_NewServer(t *testing.T) {
@@ -20,7 +30,7 @@ func TestIngress_NewServer(t *testing.T) {
 	defer srv.Shutdown()
 
 	assert.NotNil(t, srv.RequestCache)
-	assert.Equal(t, len(srv.RequestCache.Cache), 0)
+	assert.Equal(t, len(GetMemoryCache(t, srv).Cache), 0)
 	assert.Equal(t, srv.NATSConnection.Status(), nats.CONNECTED)
 }
 
@@ -60,17 +70,19 @@ func TestIngressHandleBadCalls(t *testing.T) {
 	fixture := NewRelayFixture(t, cf)
 	defer fixture.Shutdown()
 
-	data := [][]byte{
-		[]byte(`{"jsonrpc": "2.0", "method": "dummyModule_dummyMethod", "params": [1,2]}`),
-		[]byte(`{"id": null, "method": "dummyModule_dummyMethod", "params": [1,2]}`),
-		[]byte(`{"id": 1, "jsonrpc": "1.0", "method": "dummyModule_dummyMethod", "params": [1,2]}`),
-		[]byte(`{"id": 1, "jsonrpc": "2.0", "method": "dummyModuledummyMethod", "params": [1,2]}`),
-		[]byte(`{"jsonrpc": "2.0", "id": 1, "method": "calculateSum_calculateSum", "params": ["1", 2]}`),
+	data := []struct {
+		request []byte
+		id      any
+	}{
+		{[]byte(`{"id": null, "method": "dummyModule_dummyMethod", "params": [1,2]}`), nil},
+		{[]byte(`{"id": 1, "jsonrpc": "1.0", "method": "dummyModule_dummyMethod", "params": [1,2]}`), 1.0},
+		{[]byte(`{"id": "a", "jsonrpc": "2.0", "method": "dummyModuledummyMethod", "params": [1,2]}`), "a"},
+		{[]byte(`{"id": 1, "jsonrpc": "2.0", "method": `), nil},
 	}
 
 	for _, v := range data {
 		resp, err := http.Post(
-			"http://"+cf.Ingress.GetHostWithPort(), "application/json", bytes.NewBuffer(v))
+			"http://"+cf.Ingress.GetHostWithPort(), "application/json", bytes.NewBuffer(v.request))
 		assert.NoError(t, err)
 		assert.Equal(t, resp.StatusCode, http.StatusBadRequest)
 
@@ -80,7 +92,1343 @@ func TestIngressHandleBadCalls(t *testing.T) {
 		assert.NotNil(t, response.Error)
 		assert.NotNil(t, response.Error.Code)
 		assert.NotNil(t, response.Error.Message)
-		assert.Nil(t, response.ID)
+		assert.Equal(t, v.id, response.ID)
 		assert.Equal(t, response.JSONRPC, "2.0")
 	}
 }
+
+func TestIngressHandleInvalidIDs(t *testing.T) {
+	cf := NewTestConfig()
+	fixture := NewRelayFixture(t, cf)
+	defer fixture.Shutdown()
+
+	for _, id := range []string{`[1]`, `{"a": 1}`, `true`} {
+		httpResp, code := postWithHeaders(t, cf,
+			`{"jsonrpc": "2.0", "id": `+id+`, "method": "calculateSum_calculateSum", "params": [1, 2]}`, nil)
+		assert.Equal(t, http.StatusBadRequest, httpResp.StatusCode)
+		assert.Equal(t, egress.RPCErrorNum(egress.RPCErrorInvalidRequest), code, id)
+
+		var response egress.RPCErrorResponse
+		assert.NoError(t, json.NewDecoder(httpResp.Body).Decode(&response))
+		assert.Nil(t, response.ID)
+	}
+}
+
+func TestIngressHandleBackendError(t *testing.T) {
+	cf := NewTestConfig()
+	fixture := NewRelayFixture(t, cf)
+	defer fixture.Shutdown()
+
+	resp, err := http.Post(
+		"http://"+cf.Ingress.GetHostWithPort(),
+		"application/json",
+		bytes.NewBuffer([]byte(`{"jsonrpc": "2.0", "id": 1, "method": "calculateSum_calculateSum", "params": ["1", 2]}`)))
+	assert.NoError(t, err)
+	assert.Equal(t, resp.StatusCode, http.StatusBadRequest)
+
+	var response egress.RPCErrorResponse
+	err = json.NewDecoder(resp.Body).Decode(&response)
+	assert.NoError(t, err)
+	assert.NotNil(t, response.Error)
+	assert.Equal(t, response.Error.Code, egress.RPCErrorNum(egress.RPCErrorInvalidParams))
+	assert.Equal(t, response.ID, float64(1))
+	assert.Equal(t, response.JSONRPC, "2.0")
+}
+
+func TestIngressCoalesceCalls(t *testing.T) {
+	cf := NewTestConfig()
+	fixture := NewRelayFixture(t, cf)
+	defer fixture.Shutdown()
+
+	nc, err := nats.Connect(cf.NATS.ServerURL)
+	assert.NoError(t, err)
+	defer nc.Close()
+	sub, err := nc.SubscribeSync(cf.NATS.GetSubjectName("calculateSum", "calculateSum"))
+	assert.NoError(t, err)
+
+	numCalls := 20
+	wg := sync.WaitGroup{}
+	wg.Add(numCalls)
+	for i := 0; i < numCalls; i++ {
+		go func(id int) {
+			defer wg.Done()
+			jsonResp, err := http.Post(
+				"http://"+cf.Ingress.GetHostWithPort(),
+				"application/json",
+				bytes.NewBuffer([]byte(fmt.Sprintf(
+					`{"jsonrpc": "2.0", "id": %d, "method": "calculateSum_calculateSum", "params": [5, 6]}`, id))))
+			assert.NoError(t, err)
+
+			var resp RPCCalcSumResponse
+			err = json.NewDecoder(jsonResp.Body).Decode(&resp)
+			assert.NoError(t, err)
+			assert.Equal(t, RPCCalcSumResponse{JSONRPC: "2.0", Result: 11, ID: id}, resp)
+		}(i)
+	}
+	wg.Wait()
+
+	_, err = sub.NextMsg(time.Second)
+	assert.NoError(t, err)
+	_, err = sub.NextMsg(100 * time.Millisecond)
+	assert.ErrorIs(t, err, nats.ErrTimeout)
+}
+
+// panickingCache is a cache which panics when a response is added to it. The panicked channel, if set,
+// is closed right before that
+type panickingCache struct {
+	ingress.Cache
+	panicked chan struct{}
+}
+
+func (cache *panickingCache) Add(*egress.RPCRequest, *egress.RPCRawResponse) {
+	// Give the concurrent calls time to wait for the panicking one
+	time.Sleep(100 * time.Millisecond)
+	if cache.panicked != nil {
+		close(cache.panicked)
+	}
+	panic("cache failure")
+}
+
+func TestIngressCoalescedCallPanic(t *testing.T) {
+	cf := NewTestConfig()
+	fixture := NewRelayFixture(t, cf)
+	defer fixture.Shutdown()
+	cache := fixture.IngressServer.RequestCache
+	fixture.IngressServer.RequestCache = &panickingCache{Cache: cache}
+
+	numCalls := 5
+	wg := sync.WaitGroup{}
+	wg.Add(numCalls)
+	for i := 0; i < numCalls; i++ {
+		go func() {
+			defer wg.Done()
+			httpResp, code := postWithHeaders(t, cf,
+				`{"jsonrpc": "2.0", "id": 1, "method": "calculateSum_calculateSum", "params": [1, 2]}`, nil)
+			assert.Equal(t, http.StatusInternalServerError, httpResp.StatusCode)
+			assert.Equal(t, egress.RPCErrorNum(egress.RPCErrorInternalError), code)
+		}()
+	}
+	wg.Wait()
+
+	// The failed call doesn't block the next ones
+	fixture.IngressServer.RequestCache = cache
+	httpResp, resp := postCalcSum(t, cf, nil)
+	assert.Equal(t, http.StatusOK, httpResp.StatusCode)
+	assert.Equal(t, RPCCalcSumResponse{JSONRPC: "2.0", Result: 3, ID: 1}, resp)
+}
+
+func TestIngressHandleBatch(t *testing.T) {
+	cf := NewTestConfig()
+	fixture := NewRelayFixture(t, cf)
+	defer fixture.Shutdown()
+
+	resp, err := http.Post(
+		"http://"+cf.Ingress.GetHostWithPort(),
+		"application/json",
+		bytes.NewBuffer([]byte(`[
+			{"jsonrpc": "2.0", "id": 1, "method": "calculateSum_calculateSum", "params": [1, 2]},
+			{"jsonrpc": "2.0", "id": 2, "method": "calculateSumcalculateSum", "params": [1, 2]},
+			{"jsonrpc": "2.0", "id": 3, "method": "calculateSum_calculateSum", "params": [3, 4]},
+			{"jsonrpc": "2.0", "id": 1, "method": "calculateSum_calculateSum", "params": [1, 2]}
+		]`)))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var batch []map[string]any
+	err = json.NewDecoder(resp.Body).Decode(&batch)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, len(batch))
+
+	assert.Equal(t, float64(3), batch[0]["result"])
+	assert.NotNil(t, batch[1]["error"])
+	assert.Equal(t, float64(7), batch[2]["result"])
+	assert.Equal(t, float64(3), batch[3]["result"])
+}
+
+func TestIngressHandleBatchCallsNotObjects(t *testing.T) {
+	cf := NewTestConfig()
+	fixture := NewRelayFixture(t, cf)
+	defer fixture.Shutdown()
+
+	httpResp, err := http.Post(
+		"http://"+cf.Ingress.GetHostWithPort(),
+		"application/json",
+		bytes.NewBuffer([]byte(`[1, "2", {"jsonrpc": "2.0", "id": 3, "method": "calculateSum_calculateSum", "params": [3, 4]}]`)))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, httpResp.StatusCode)
+	body, err := io.ReadAll(httpResp.Body)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `[
+		{"jsonrpc": "2.0", "id": null, "error": {"code": -32600, "message": "invalid request batch call is not an object"}},
+		{"jsonrpc": "2.0", "id": null, "error": {"code": -32600, "message": "invalid request batch call is not an object"}},
+		{"jsonrpc": "2.0", "id": 3, "result": 7}
+	]`, string(body))
+}
+
+// keyPanickingCache is a cache which panics when the request with the given key is looked up
+type keyPanickingCache struct {
+	ingress.Cache
+	key string
+}
+
+func (cache *keyPanickingCache) GetRequestByKey(requestKey string) (*ingress.CachedRequest, bool) {
+	if requestKey == cache.key {
+		panic("cache failure")
+	}
+	return cache.Cache.GetRequestByKey(requestKey)
+}
+
+func TestIngressHandleBatchCallPanic(t *testing.T) {
+	cf := NewTestConfig()
+	fixture := NewRelayFixture(t, cf)
+	defer fixture.Shutdown()
+	fixture.IngressServer.RequestCache = &keyPanickingCache{
+		fixture.IngressServer.RequestCache, NewRPCCalcRequest(append(make([]any, 0), 1, 2)).GetRequestKey()}
+
+	httpResp, err := http.Post(
+		"http://"+cf.Ingress.GetHostWithPort(),
+		"application/json",
+		bytes.NewBuffer([]byte(`[
+			{"jsonrpc": "2.0", "id": 1, "method": "calculateSum_calculateSum", "params": [1, 2]},
+			{"jsonrpc": "2.0", "id": 2, "method": "calculateSum_calculateSum", "params": [3, 4]}
+		]`)))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, httpResp.StatusCode)
+	var batch []map[string]any
+	assert.NoError(t, json.NewDecoder(httpResp.Body).Decode(&batch))
+	assert.Equal(t, 2, len(batch))
+	assert.Equal(t, float64(1), batch[0]["id"])
+	assert.Equal(t, float64(egress.RPCErrorInternalError), batch[0]["error"].(map[string]any)["code"])
+	assert.Equal(t, float64(7), batch[1]["result"])
+}
+
+func TestIngressHandleBadBatches(t *testing.T) {
+	cf := NewTestConfig()
+	fixture := NewRelayFixture(t, cf)
+	defer fixture.Shutdown()
+
+	data := [][]byte{
+		[]byte(`[]`),
+		[]byte(`[{"jsonrpc": "2.0", "id": 1, "method": "calculateSum_calculateSum", "params": [1, 2]}`),
+	}
+
+	for _, v := range data {
+		resp, err := http.Post(
+			"http://"+cf.Ingress.GetHostWithPort(), "application/json", bytes.NewBuffer(v))
+		assert.NoError(t, err)
+		assert.Equal(t, resp.StatusCode, http.StatusBadRequest)
+
+		var response egress.RPCErrorResponse
+		err = json.NewDecoder(resp.Body).Decode(&response)
+		assert.NoError(t, err)
+		assert.NotNil(t, response.Error)
+	}
+}
+
+func TestIngressRequestLimits(t *testing.T) {
+	cf := NewTestConfig()
+	cf.Ingress.MaxRequestBytes = 512
+	cf.Ingress.MaxBatchSize = 2
+	cf.Ingress.MaxBatchConcurrency = 1
+	fixture := NewRelayFixture(t, cf)
+	defer fixture.Shutdown()
+
+	call := `{"jsonrpc": "2.0", "id": 1, "method": "calculateSum_calculateSum", "params": [1, 2]}`
+	httpResp, errCode := postWithHeaders(t, cf, `[`+call+`,`+call+`,`+call+`]`, nil)
+	assert.Equal(t, http.StatusBadRequest, httpResp.StatusCode)
+	assert.Equal(t, egress.RPCErrorNum(egress.RPCErrorInvalidRequest), errCode)
+
+	// Calls of a batch are handled one at a time
+	resp, err := http.Post("http://"+cf.Ingress.GetHostWithPort(), "application/json",
+		bytes.NewBufferString(`[`+call+`,`+strings.Replace(call, "[1, 2]", "[3, 4]", 1)+`]`))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var batch []map[string]any
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&batch))
+	if assert.Len(t, batch, 2) {
+		assert.Equal(t, float64(3), batch[0]["result"])
+		assert.Equal(t, float64(7), batch[1]["result"])
+	}
+
+	httpResp, errCode = postWithHeaders(t, cf,
+		`{"jsonrpc": "2.0", "id": 1, "method": "calculateSum_calculateSum", "params": [1, 2], "x": "`+
+			strings.Repeat("a", 512)+`"}`, nil)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, httpResp.StatusCode)
+	assert.Equal(t, egress.RPCErrorNum(egress.RPCErrorInvalidRequest), errCode)
+}
+
+func TestIngressHandleNotification(t *testing.T) {
+	cf := NewTestConfig()
+	fixture := NewRelayFixture(t, cf)
+	defer fixture.Shutdown()
+
+	nc, err := nats.Connect(cf.NATS.ServerURL)
+	assert.NoError(t, err)
+	defer nc.Close()
+	sub, err := nc.SubscribeSync(cf.NATS.GetSubjectName("calculateSum", "calculateSum"))
+	assert.NoError(t, err)
+
+	resp, err := http.Post(
+		"http://"+cf.Ingress.GetHostWithPort(),
+		"application/json",
+		bytes.NewBuffer([]byte(`{"jsonrpc": "2.0", "method": "calculateSum_calculateSum", "params": [1, 2]}`)))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	// Notification is published without a reply subject
+	msg, err := sub.NextMsg(time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, "", msg.Reply)
+
+	_, ok := fixture.IngressServer.RequestCache.GetRequestByKey(
+		NewRPCCalcRequest(append(make([]any, 0), 1.0, 2.0)).GetRequestKey())
+	assert.False(t, ok)
+}
+
+func TestIngressHandleNotificationBatch(t *testing.T) {
+	cf := NewTestConfig()
+	fixture := NewRelayFixture(t, cf)
+	defer fixture.Shutdown()
+
+	resp, err := http.Post(
+		"http://"+cf.Ingress.GetHostWithPort(),
+		"application/json",
+		bytes.NewBuffer([]byte(`[
+			{"jsonrpc": "2.0", "method": "calculateSum_calculateSum", "params": [1, 2]},
+			{"jsonrpc": "2.0", "method": "calculateSum_calculateSum", "params": [3, 4]}
+		]`)))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	resp, err = http.Post(
+		"http://"+cf.Ingress.GetHostWithPort(),
+		"application/json",
+		bytes.NewBuffer([]byte(`[
+			{"jsonrpc": "2.0", "method": "calculateSum_calculateSum", "params": [1, 2]},
+			{"jsonrpc": "2.0", "id": 2, "method": "calculateSum_calculateSum", "params": [3, 4]}
+		]`)))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var batch []RPCCalcSumResponse
+	err = json.NewDecoder(resp.Body).Decode(&batch)
+	assert.NoError(t, err)
+	assert.Equal(t, []RPCCalcSumResponse{{JSONRPC: "2.0", Result: 7, ID: 2}}, batch)
+}
+
+func TestIngressCachedResponseID(t *testing.T) {
+	cf := NewTestConfig()
+	fixture := NewRelayFixture(t, cf)
+	defer fixture.Shutdown()
+
+	for _, id := range []int{1, 42, 43} {
+		jsonResp, err := http.Post(
+			"http://"+cf.Ingress.GetHostWithPort(),
+			"application/json",
+			bytes.NewBuffer([]byte(fmt.Sprintf(
+				`{"jsonrpc": "2.0", "id": %d, "method": "calculateSum_calculateSum", "params": [1, 2]}`, id))))
+		assert.NoError(t, err)
+
+		var resp RPCCalcSumResponse
+		err = json.NewDecoder(jsonResp.Body).Decode(&resp)
+		assert.NoError(t, err)
+		assert.Equal(t, RPCCalcSumResponse{JSONRPC: "2.0", Result: 3, ID: id}, resp)
+	}
+	assert.Equal(t, 1, len(GetMemoryCache(t, fixture.IngressServer).Cache))
+}
+
+// backdateCachedRequests moves the cache time of every cached request into the past
+func backdateCachedRequests(t *testing.T, srv *ingress.Server, age time.Duration) {
+	cache := GetMemoryCache(t, srv)
+	cache.Lock()
+	defer cache.Unlock()
+	for _, cachedRequest := range cache.Cache {
+		cachedRequest.CTime = time.Now().Add(-age)
+	}
+}
+
+// postWithHeaders sends a call to ingress with the given HTTP headers and returns the HTTP response and
+// the error code of the JSON-RPC response, if any. The response body is read and closed, the returned
+// response holds a copy of it
+func postWithHeaders(t *testing.T, cf *relayutil.Config, data string, headers map[string]string) (*http.Response, egress.RPCErrorNum) {
+	req, err := http.NewRequest(http.MethodPost, "http://"+cf.Ingress.GetHostWithPort(), bytes.NewBufferString(data))
+	assert.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	httpResp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(httpResp.Body)
+	assert.NoError(t, err)
+	assert.NoError(t, httpResp.Body.Close())
+	httpResp.Body = io.NopCloser(bytes.NewReader(body))
+
+	var resp struct{ Error *egress.RPCError }
+	assert.NoError(t, json.Unmarshal(body, &resp))
+	if resp.Error == nil {
+		return httpResp, 0
+	}
+	return httpResp, resp.Error.Code
+}
+
+// postCalcSum sends calculateSum(1, 2) to ingress with the given HTTP headers and returns the HTTP response
+// and the JSON-RPC response
+func postCalcSum(t *testing.T, cf *relayutil.Config, headers map[string]string) (*http.Response, RPCCalcSumResponse) {
+	httpResp, _ := postWithHeaders(t, cf,
+		`{"jsonrpc": "2.0", "id": 1, "method": "calculateSum_calculateSum", "params": [1, 2]}`, headers)
+	var resp RPCCalcSumResponse
+	assert.NoError(t, json.NewDecoder(httpResp.Body).Decode(&resp))
+	return httpResp, resp
+}
+
+func TestIngressStaleWhileRevalidate(t *testing.T) {
+	cf := NewTestConfig()
+	cf.Ingress.StaleWhileRevalidate = true
+	fixture := NewRelayFixture(t, cf)
+	defer fixture.Shutdown()
+
+	postCalcSum(t, cf, nil)
+	backdateCachedRequests(t, fixture.IngressServer,
+		relayutil.GetDurationInSeconds(cf.Ingress.RefreshCachedRequestThreshold)+time.Second)
+
+	nc, err := nats.Connect(cf.NATS.ServerURL)
+	assert.NoError(t, err)
+	defer nc.Close()
+	sub, err := nc.SubscribeSync(cf.NATS.GetSubjectName("calculateSum", "calculateSum"))
+	assert.NoError(t, err)
+
+	_, resp := postCalcSum(t, cf, nil)
+	assert.Equal(t, RPCCalcSumResponse{JSONRPC: "2.0", Result: 3, ID: 1}, resp)
+
+	// The refresh is done in the background
+	_, err = sub.NextMsg(time.Second)
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		cachedRequest, ok := fixture.IngressServer.RequestCache.GetRequestByKey(
+			NewRPCCalcRequest(append(make([]any, 0), 1, 2)).GetRequestKey())
+		return ok && !cachedRequest.IsRequestStale(
+			relayutil.GetDurationInSeconds(cf.Ingress.RefreshCachedRequestThreshold))
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestIngressStaleWhileRevalidatePanic(t *testing.T) {
+	cf := NewTestConfig()
+	cf.Ingress.StaleWhileRevalidate = true
+	fixture := NewRelayFixture(t, cf)
+	defer fixture.Shutdown()
+
+	postCalcSum(t, cf, nil)
+	backdateCachedRequests(t, fixture.IngressServer,
+		relayutil.GetDurationInSeconds(cf.Ingress.RefreshCachedRequestThreshold)+time.Second)
+	cache := fixture.IngressServer.RequestCache
+	panicking := &panickingCache{Cache: cache, panicked: make(chan struct{})}
+	fixture.IngressServer.RequestCache = panicking
+
+	// The background refresh panics, the stale response is returned anyway
+	_, resp := postCalcSum(t, cf, nil)
+	assert.Equal(t, RPCCalcSumResponse{JSONRPC: "2.0", Result: 3, ID: 1}, resp)
+	select {
+	case <-panicking.panicked:
+	case <-time.After(time.Second):
+		t.Fatal("background refresh did not run")
+	}
+
+	// The failed refresh doesn't block the next ones
+	fixture.IngressServer.RequestCache = cache
+	assert.Eventually(t, func() bool {
+		postCalcSum(t, cf, nil)
+		cachedRequest, ok := cache.GetRequestByKey(NewRPCCalcRequest(append(make([]any, 0), 1, 2)).GetRequestKey())
+		return ok && !cachedRequest.IsRequestStale(
+			relayutil.GetDurationInSeconds(cf.Ingress.RefreshCachedRequestThreshold))
+	}, time.Second, 50*time.Millisecond)
+}
+
+func TestIngressStaleIfError(t *testing.T) {
+	cf := NewTestConfig()
+	cf.Ingress.StaleIfErrorThreshold = 60.0
+	cf.Ingress.NATSCallWaitTimeout = 0.5
+	fixture := NewRelayFixture(t, cf)
+	defer fixture.Shutdown()
+
+	postCalcSum(t, cf, nil)
+	backdateCachedRequests(t, fixture.IngressServer,
+		relayutil.GetDurationInSeconds(cf.Ingress.ExpireCachedRequestThreshold)+time.Second)
+
+	// Egress is down, the expired request is returned instead
+	assert.NoError(t, fixture.EgressServer.Shutdown())
+	httpResp, resp := postCalcSum(t, cf, nil)
+	assert.Equal(t, http.StatusOK, httpResp.StatusCode)
+	assert.Equal(t, RPCCalcSumResponse{JSONRPC: "2.0", Result: 3, ID: 1}, resp)
+
+	// Expired past the stale-if-error threshold
+	backdateCachedRequests(t, fixture.IngressServer, relayutil.GetDurationInSeconds(
+		cf.Ingress.ExpireCachedRequestThreshold+cf.Ingress.StaleIfErrorThreshold)+time.Second)
+	httpResp, err := http.Post(
+		"http://"+cf.Ingress.GetHostWithPort(),
+		"application/json",
+		bytes.NewBuffer([]byte(`{"jsonrpc": "2.0", "id": 1, "method": "calculateSum_calculateSum", "params": [1, 2]}`)))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, httpResp.StatusCode)
+
+	fixture.EgressServer, err = egress.NewServer(cf)
+	assert.NoError(t, err)
+}
+
+func TestIngressConfig_GetCachePolicy(t *testing.T) {
+	cf := NewTestConfig()
+	cf.Ingress.CachePolicies = map[string]*relayutil.CachePolicy{
+		"calculateSum":              {ExpireCachedRequestThreshold: 3600},
+		"calculateSum_calculateSum": {RefreshCachedRequestThreshold: 60},
+		"reverseString":             {NoCache: true},
+	}
+
+	policy := cf.Ingress.GetCachePolicy("calculateSum", "calculateSum")
+	assert.Equal(t, 60.0, policy.RefreshCachedRequestThreshold)
+	assert.Equal(t, cf.Ingress.ExpireCachedRequestThreshold, policy.ExpireCachedRequestThreshold)
+
+	policy = cf.Ingress.GetCachePolicy("calculateSum", "otherMethod")
+	assert.Equal(t, cf.Ingress.RefreshCachedRequestThreshold, policy.RefreshCachedRequestThreshold)
+	assert.Equal(t, 3600.0, policy.ExpireCachedRequestThreshold)
+
+	policy = cf.Ingress.GetCachePolicy("reverseString", "reverseString")
+	assert.False(t, policy.IsCacheable(0))
+
+	policy = cf.Ingress.GetCachePolicy("otherModule", "otherMethod")
+	assert.Equal(t, relayutil.CachePolicy{
+		RefreshCachedRequestThreshold: cf.Ingress.RefreshCachedRequestThreshold,
+		ExpireCachedRequestThreshold:  cf.Ingress.ExpireCachedRequestThreshold,
+	}, *policy)
+	assert.True(t, policy.IsCacheable(1<<20))
+
+	assert.Equal(t, 3600.0, cf.Ingress.GetMaxExpireCachedRequestThreshold())
+}
+
+func TestIngressCachePolicies(t *testing.T) {
+	cf := NewTestConfig()
+	fixture := NewRelayFixture(t, cf)
+	defer fixture.Shutdown()
+	cache := GetMemoryCache(t, fixture.IngressServer)
+
+	cf.Ingress.CachePolicies = map[string]*relayutil.CachePolicy{
+		"calculateSum_calculateSum": {NoCache: true},
+	}
+	_, resp := postCalcSum(t, cf, nil)
+	assert.Equal(t, 3, resp.Result)
+	assert.Equal(t, 0, len(cache.Cache))
+
+	cf.Ingress.CachePolicies["calculateSum_calculateSum"] = &relayutil.CachePolicy{MaxResponseSize: 1}
+	_, resp = postCalcSum(t, cf, nil)
+	assert.Equal(t, 3, resp.Result)
+	assert.Equal(t, 1, len(cache.Cache))
+
+	cf.Ingress.CachePolicies["calculateSum_calculateSum"] = &relayutil.CachePolicy{ExpireCachedRequestThreshold: 3600}
+	request := NewRPCCalcRequest(append(make([]any, 0), 3, 4))
+	cache.Add(request, &egress.RPCRawResponse{JSONRPC: "2.0", Result: json.RawMessage("7")})
+	cachedRequest, ok := cache.GetRequestByValue(request)
+	assert.True(t, ok)
+	assert.Equal(t, time.Hour, cachedRequest.ExpiryTime.Sub(cachedRequest.CTime))
+}
+
+func TestIngress_ParseCacheDirectives(t *testing.T) {
+	header := http.Header{}
+	header.Add("Cache-Control", "No-Cache, max-age=\"30\"")
+	header.Add("Cache-Control", "no-store, private")
+	assert.Equal(t, &ingress.CacheDirectives{NoCache: true, NoStore: true, MaxAge: 30 * time.Second, HasMaxAge: true},
+		ingress.ParseCacheDirectives(header))
+
+	header.Set("Cache-Control", "max-age=-1, max-age=abc")
+	assert.Equal(t, &ingress.CacheDirectives{}, ingress.ParseCacheDirectives(header))
+}
+
+func TestIngressCacheHeaders(t *testing.T) {
+	cf := NewTestConfig()
+	fixture := NewRelayFixture(t, cf)
+	defer fixture.Shutdown()
+
+	httpResp, resp := postCalcSum(t, cf, nil)
+	assert.Equal(t, 3, resp.Result)
+	assert.Equal(t, ingress.CacheStatusMiss, httpResp.Header.Get("X-Cache"))
+	assert.Equal(t, "max-age=5", httpResp.Header.Get("Cache-Control"))
+
+	backdateCachedRequests(t, fixture.IngressServer, 2*time.Second)
+	httpResp, resp = postCalcSum(t, cf, nil)
+	assert.Equal(t, 3, resp.Result)
+	assert.Equal(t, ingress.CacheStatusHit, httpResp.Header.Get("X-Cache"))
+	assert.Equal(t, "2", httpResp.Header.Get("Age"))
+	assert.Equal(t, "max-age=2", httpResp.Header.Get("Cache-Control"))
+
+	cf.Ingress.CachePolicies = map[string]*relayutil.CachePolicy{
+		"calculateSum": {NoCache: true},
+	}
+	httpResp, _ = postCalcSum(t, cf, nil)
+	assert.Equal(t, ingress.CacheStatusMiss, httpResp.Header.Get("X-Cache"))
+	assert.Equal(t, "no-store", httpResp.Header.Get("Cache-Control"))
+}
+
+func TestIngressCacheControlDirectives(t *testing.T) {
+	cf := NewTestConfig()
+	fixture := NewRelayFixture(t, cf)
+	defer fixture.Shutdown()
+	cache := GetMemoryCache(t, fixture.IngressServer)
+
+	// no-store neither reads nor fills the cache
+	httpResp, resp := postCalcSum(t, cf, map[string]string{"Cache-Control": "no-store"})
+	assert.Equal(t, 3, resp.Result)
+	assert.Equal(t, ingress.CacheStatusMiss, httpResp.Header.Get("X-Cache"))
+	assert.Equal(t, 0, len(cache.Cache))
+
+	postCalcSum(t, cf, nil)
+	assert.Equal(t, 1, len(cache.Cache))
+	backdateCachedRequests(t, fixture.IngressServer, 2*time.Second)
+
+	// no-cache skips the lookup and replaces the cached request
+	httpResp, _ = postCalcSum(t, cf, map[string]string{"Cache-Control": "no-cache"})
+	assert.Equal(t, ingress.CacheStatusMiss, httpResp.Header.Get("X-Cache"))
+	httpResp, _ = postCalcSum(t, cf, nil)
+	assert.Equal(t, ingress.CacheStatusHit, httpResp.Header.Get("X-Cache"))
+	assert.Equal(t, "0", httpResp.Header.Get("Age"))
+
+	// max-age limits the age of the cached request
+	backdateCachedRequests(t, fixture.IngressServer, 2*time.Second)
+	httpResp, _ = postCalcSum(t, cf, map[string]string{"Cache-Control": "max-age=1"})
+	assert.Equal(t, ingress.CacheStatusMiss, httpResp.Header.Get("X-Cache"))
+
+	// and may allow older requests than the refresh threshold until they expire
+	backdateCachedRequests(t, fixture.IngressServer, 7*time.Second)
+	httpResp, _ = postCalcSum(t, cf, map[string]string{"Cache-Control": "max-age=8"})
+	assert.Equal(t, ingress.CacheStatusHit, httpResp.Header.Get("X-Cache"))
+	assert.Equal(t, "max-age=0", httpResp.Header.Get("Cache-Control"))
+}
+
+func TestIngressHandleNamedParams(t *testing.T) {
+	cf := NewTestConfig()
+	fixture := NewRelayFixture(t, cf)
+	defer fixture.Shutdown()
+
+	jsonResp, err := http.Post(
+		"http://"+cf.Ingress.GetHostWithPort(),
+		"application/json",
+		bytes.NewBuffer([]byte(`{"jsonrpc": "2.0", "id": 1, "method": "calculateSum_calculateSum", "params": {"b": 2, "a": 1}}`)))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, jsonResp.StatusCode)
+	var resp RPCCalcSumResponse
+	assert.NoError(t, json.NewDecoder(jsonResp.Body).Decode(&resp))
+	assert.Equal(t, RPCCalcSumResponse{JSONRPC: "2.0", Result: 3, ID: 1}, resp)
+
+	jsonResp, err = http.Post(
+		"http://"+cf.Ingress.GetHostWithPort(),
+		"application/json",
+		bytes.NewBuffer([]byte(`{"jsonrpc": "2.0", "id": 1, "method": "calculateSum_calculateSum", "params": {"c": 2}}`)))
+	assert.NoError(t, err)
+	var errResp egress.RPCErrorResponse
+	assert.NoError(t, json.NewDecoder(jsonResp.Body).Decode(&errResp))
+	assert.Equal(t, egress.RPCErrorNum(egress.RPCErrorInvalidParams), errResp.Error.Code)
+}
+
+func TestIngressValidateParams(t *testing.T) {
+	cf := NewTestConfig()
+	minimum := 0.0
+	cf.JRPCServer.RPCMethodSchemas["calculateSum_calculateSum"] = &relayutil.RPCMethodSchema{
+		Params: []*relayutil.RPCParamSchema{
+			{Name: "a", Type: egress.RPCParamTypeNumber, Minimum: &minimum},
+			{Name: "b", Type: egress.RPCParamTypeNumber},
+		},
+	}
+	fixture := NewRelayFixture(t, cf)
+	defer fixture.Shutdown()
+
+	// Invalid requests never reach egress
+	nc, err := nats.Connect(cf.NATS.ServerURL)
+	assert.NoError(t, err)
+	defer nc.Close()
+	sub, err := nc.SubscribeSync(cf.NATS.GetSubjectName("calculateSum", "calculateSum"))
+	assert.NoError(t, err)
+
+	jsonResp, err := http.Post(
+		"http://"+cf.Ingress.GetHostWithPort(),
+		"application/json",
+		bytes.NewBuffer([]byte(`{"jsonrpc": "2.0", "id": 1, "method": "calculateSum_calculateSum", "params": [-1, 2]}`)))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, jsonResp.StatusCode)
+	var errResp egress.RPCErrorResponse
+	assert.NoError(t, json.NewDecoder(jsonResp.Body).Decode(&errResp))
+	assert.Equal(t, egress.RPCErrorNum(egress.RPCErrorInvalidParams), errResp.Error.Code)
+	assert.Contains(t, errResp.Error.Message, `param "a" must be at least 0`)
+
+	// Numbers which can't be given a request key are rejected as well
+	httpResp, errCode := postWithHeaders(t, cf,
+		`{"jsonrpc": "2.0", "id": 1, "method": "calculateSum_calculateSum", "params": [1e9999999999999, 2]}`, nil)
+	assert.Equal(t, http.StatusBadRequest, httpResp.StatusCode)
+	assert.Equal(t, egress.RPCErrorNum(egress.RPCErrorInvalidParams), errCode)
+
+	_, err = sub.NextMsg(100 * time.Millisecond)
+	assert.ErrorIs(t, err, nats.ErrTimeout)
+
+	_, resp := postCalcSum(t, cf, nil)
+	assert.Equal(t, 3, resp.Result)
+}
+
+func TestIngressHandleNullResult(t *testing.T) {
+	cf := NewTestConfig()
+	cf.JRPCServer.EnabledRPCModules[NullServiceName] = []string{"nothing", "null"}
+	fixture := NewRelayFixture(t, cf)
+	defer fixture.Shutdown()
+
+	for _, method := range []string{"null_nothing", "null_null"} {
+		jsonResp, err := http.Post(
+			"http://"+cf.Ingress.GetHostWithPort(),
+			"application/json",
+			bytes.NewBuffer([]byte(`{"jsonrpc": "2.0", "id": 1, "method": "`+method+`", "params": []}`)))
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, jsonResp.StatusCode)
+		body, err := io.ReadAll(jsonResp.Body)
+		assert.NoError(t, err)
+		assert.JSONEq(t, `{"jsonrpc": "2.0", "id": 1, "result": null}`, string(body))
+	}
+}
+
+func TestIngressHandleBackendInternalError(t *testing.T) {
+	cf := NewTestConfig()
+	cf.JRPCServer.EnabledRPCModules[ErrorServiceName] = []string{relayutil.RPCMethodWildcard}
+	cf.Egress.InternalErrorRedaction = relayutil.ErrorRedactionNone
+	fixture := NewRelayFixture(t, cf)
+	defer fixture.Shutdown()
+
+	jsonResp, err := http.Post(
+		"http://"+cf.Ingress.GetHostWithPort(),
+		"application/json",
+		bytes.NewBuffer([]byte(`{"jsonrpc": "2.0", "id": 1, "method": "error_crash", "params": []}`)))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadGateway, jsonResp.StatusCode)
+	body, err := io.ReadAll(jsonResp.Body)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"jsonrpc":"2.0","id":1,"error":{"code":-32603,"message":"crash","data":"stack trace"}}`, string(body))
+	assert.Equal(t, 0, len(GetMemoryCache(t, fixture.IngressServer).Cache))
+}
+
+func TestIngressHandleEgressFailures(t *testing.T) {
+	cf := NewTestConfig()
+	fixture := NewRelayFixture(t, cf)
+	defer fixture.Shutdown()
+	// Egress is replaced with a stub replying with the given data
+	assert.NoError(t, fixture.EgressServer.Shutdown())
+	nc, err := nats.Connect(cf.NATS.ServerURL)
+	assert.NoError(t, err)
+	defer nc.Close()
+	var stubReply []byte
+	_, err = nc.Subscribe(cf.NATS.SubjectName, func(msg *nats.Msg) {
+		_ = msg.Respond(stubReply)
+	})
+	assert.NoError(t, err)
+
+	backendUnavailable, _ := json.Marshal(egress.NewEgressReply(egress.ReplyStatusRelayError,
+		egress.RelayErrorBackendUnavailable, egress.CreateErrorResponse(nil, egress.RPCErrorInternalError)))
+	relayInternal, _ := json.Marshal(egress.NewEgressReply(egress.ReplyStatusRelayError,
+		egress.RelayErrorInternal, egress.CreateErrorResponse(nil, egress.RPCErrorInternalError)))
+	cases := []struct {
+		reply  []byte
+		status int
+	}{
+		{[]byte(`{bad`), http.StatusInternalServerError},
+		{[]byte(`{"jsonrpc": "2.0", "id": 1, "result": 3}`), http.StatusInternalServerError},
+		{[]byte(`{"version": 1, "status": "ok", "response": {"error": {"code": "x"}}}`), http.StatusInternalServerError},
+		{[]byte(`{"version": 1, "status": "backendError", "response": {"error": []}}`), http.StatusInternalServerError},
+		{backendUnavailable, http.StatusBadGateway},
+		{relayInternal, http.StatusInternalServerError},
+	}
+	for _, c := range cases {
+		stubReply = c.reply
+		jsonResp, err := http.Post(
+			"http://"+cf.Ingress.GetHostWithPort(),
+			"application/json",
+			bytes.NewBuffer([]byte(`{"jsonrpc": "2.0", "id": 1, "method": "calculateSum_calculateSum", "params": [1, 2]}`)))
+		assert.NoError(t, err)
+		assert.Equal(t, c.status, jsonResp.StatusCode, string(c.reply))
+
+		var errResp egress.RPCErrorResponse
+		assert.NoError(t, json.NewDecoder(jsonResp.Body).Decode(&errResp))
+		assert.Equal(t, egress.RPCErrorNum(egress.RPCErrorInternalError), errResp.Error.Code)
+		assert.Equal(t, 1.0, errResp.ID)
+	}
+	assert.Equal(t, 0, len(GetMemoryCache(t, fixture.IngressServer).Cache))
+
+	nc.Close()
+	fixture.EgressServer, err = egress.NewServer(cf)
+	assert.NoError(t, err)
+}
+
+func TestIngressHTTPStatusMode(t *testing.T) {
+	cf := NewTestConfig()
+	fixture := NewRelayFixture(t, cf)
+	defer fixture.Shutdown()
+	badParams := `{"jsonrpc": "2.0", "id": 1, "method": "calculateSum_calculateSum", "params": {"c": 1}}`
+
+	jsonResp, code := postWithHeaders(t, cf, badParams, nil)
+	assert.Equal(t, http.StatusBadRequest, jsonResp.StatusCode)
+	assert.Equal(t, "application/json", jsonResp.Header.Get("Content-Type"))
+	assert.Equal(t, egress.RPCErrorNum(egress.RPCErrorInvalidParams), code)
+
+	cf.Ingress.HTTPStatusCodes = map[int]int{egress.RPCErrorInvalidParams: http.StatusUnprocessableEntity}
+	jsonResp, _ = postWithHeaders(t, cf, badParams, nil)
+	assert.Equal(t, http.StatusUnprocessableEntity, jsonResp.StatusCode)
+
+	cf.Ingress.HTTPStatusMode = relayutil.HTTPStatusModeJSONRPC
+	jsonResp, code = postWithHeaders(t, cf, badParams, nil)
+	assert.Equal(t, http.StatusOK, jsonResp.StatusCode)
+	assert.Equal(t, egress.RPCErrorNum(egress.RPCErrorInvalidParams), code)
+
+	// Egress is down
+	cf.Ingress.NATSCallWaitTimeout = 0.1
+	assert.NoError(t, fixture.EgressServer.Shutdown())
+	httpResp, err := http.Post(
+		"http://"+cf.Ingress.GetHostWithPort(),
+		"application/json",
+		bytes.NewBuffer([]byte(`{"jsonrpc": "2.0", "id": 1, "method": "calculateSum_calculateSum", "params": [5, 6]}`)))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, httpResp.StatusCode)
+	var errResp egress.RPCErrorResponse
+	assert.NoError(t, json.NewDecoder(httpResp.Body).Decode(&errResp))
+	assert.Equal(t, egress.RPCErrorNum(egress.RPCErrorInternalError), errResp.Error.Code)
+
+	fixture.EgressServer, err = egress.NewServer(cf)
+	assert.NoError(t, err)
+}
+
+func TestIngressInvalidHTTPMethod(t *testing.T) {
+	cf := NewTestConfig()
+	fixture := NewRelayFixture(t, cf)
+	defer fixture.Shutdown()
+
+	httpResp, err := http.Get("http://" + cf.Ingress.GetHostWithPort())
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusMethodNotAllowed, httpResp.StatusCode)
+	assert.Equal(t, "application/json", httpResp.Header.Get("Content-Type"))
+	var errResp egress.RPCErrorResponse
+	assert.NoError(t, json.NewDecoder(httpResp.Body).Decode(&errResp))
+	assert.Equal(t, egress.RPCErrorNum(egress.RPCErrorInvalidRequest), errResp.Error.Code)
+}
+
+func TestAuthConfig_LoadAPIKeys(t *testing.T) {
+	keysFile := filepath.Join(t.TempDir(), "keys.json")
+	assert.NoError(t, os.WriteFile(keysFile,
+		[]byte(`[{"name": "partner", "key": "partner-key", "allowedRpcMethods": {"*": ["*"]}}]`), 0600))
+
+	cf := &relayutil.AuthConfig{
+		APIKeys: []*relayutil.APIKey{
+			{Name: "team", Key: "team-key", AllowedRPCMethods: map[string][]string{"calculateSum": {"calculateSum"}}},
+		},
+		APIKeysFile: keysFile,
+	}
+	keys, err := cf.LoadAPIKeys()
+	assert.NoError(t, err)
+	if assert.Len(t, keys, 2) {
+		assert.True(t, keys[0].IsRPCMethodAllowed("calculateSum", "calculateSum"))
+		assert.False(t, keys[0].IsRPCMethodAllowed("calculateSum", "other"))
+		assert.False(t, keys[0].IsRPCMethodAllowed("reverseString", "reverseString"))
+		assert.Equal(t, "partner", keys[1].Name)
+		assert.True(t, keys[1].IsRPCMethodAllowed("reverseString", "reverseString"))
+	}
+
+	cf.APIKeys = append(cf.APIKeys, &relayutil.APIKey{Name: "other", Key: "partner-key"})
+	_, err = cf.LoadAPIKeys()
+	assert.Error(t, err)
+
+	cf.APIKeys = []*relayutil.APIKey{{Name: "empty"}}
+	_, err = cf.LoadAPIKeys()
+	assert.Error(t, err)
+}
+
+func TestIngressAPIKeyAuth(t *testing.T) {
+	cf := NewTestConfig()
+	cf.JRPCServer.EnabledRPCModules["reverseString"] = []string{"reverseString"}
+	cf.Ingress.Auth = &relayutil.AuthConfig{
+		APIKeys: []*relayutil.APIKey{
+			{Name: "team", Key: "team-key", AllowedRPCMethods: map[string][]string{"calculateSum": {"calculateSum"}}},
+		},
+	}
+	fixture := NewRelayFixture(t, cf)
+	defer fixture.Shutdown()
+
+	nc, err := nats.Connect(cf.NATS.ServerURL)
+	assert.NoError(t, err)
+	defer nc.Close()
+	sub, err := nc.SubscribeSync(cf.NATS.GetSubjectName("calculateSum", "calculateSum"))
+	assert.NoError(t, err)
+
+	calcSum := `{"jsonrpc": "2.0", "id": 1, "method": "calculateSum_calculateSum", "params": [1, 2]}`
+	for _, headers := range []map[string]string{
+		nil,
+		{"X-API-Key": "wrong-key"},
+		{"Authorization": "Basic team-key"},
+	} {
+		httpResp, errCode := postWithHeaders(t, cf, calcSum, headers)
+		assert.Equal(t, http.StatusUnauthorized, httpResp.StatusCode, headers)
+		assert.NotEmpty(t, httpResp.Header.Get("WWW-Authenticate"))
+		assert.Equal(t, egress.RPCErrorNum(egress.RPCErrorUnauthorized), errCode)
+	}
+
+	for _, headers := range []map[string]string{
+		{"X-API-Key": "team-key"},
+		{"Authorization": "Bearer team-key"},
+	} {
+		httpResp, errCode := postWithHeaders(t, cf, calcSum, headers)
+		assert.Equal(t, http.StatusOK, httpResp.StatusCode, headers)
+		assert.Zero(t, errCode)
+	}
+
+	// The caller is passed to egress
+	msg, err := sub.NextMsg(time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, "team", egress.GetCaller(msg))
+
+	httpResp, errCode := postWithHeaders(t, cf,
+		`{"jsonrpc": "2.0", "id": 1, "method": "reverseString_reverseString", "params": ["abc"]}`,
+		map[string]string{"X-API-Key": "team-key"})
+	assert.Equal(t, http.StatusForbidden, httpResp.StatusCode)
+	assert.Equal(t, egress.RPCErrorNum(egress.RPCErrorForbidden), errCode)
+}
+
+func TestIngressJWTAuth(t *testing.T) {
+	issuer := NewTestJWTIssuer(t)
+	jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+	assert.NoError(t, os.WriteFile(jwksFile, issuer.JWKS(), 0600))
+
+	newClaims := func() map[string]any {
+		return map[string]any{
+			"sub":   "service-a",
+			"iss":   "https://issuer.test",
+			"aud":   []string{"rpc-relay", "other"},
+			"exp":   time.Now().Add(time.Minute).Unix(),
+			"scope": "openid relay:calc",
+		}
+	}
+	withClaim := func(name string, value any) map[string]any {
+		claims := newClaims()
+		if value == nil {
+			delete(claims, name)
+		} else {
+			claims[name] = value
+		}
+		return claims
+	}
+	calcSum := `{"jsonrpc": "2.0", "id": 1, "method": "calculateSum_calculateSum", "params": [1, 2]}`
+	// Responses are not taken from the cache, so that every call reaches egress
+	bearer := func(token string) map[string]string {
+		return map[string]string{"Authorization": "Bearer " + token, "Cache-Control": "no-cache"}
+	}
+
+	for _, jwtConfig := range []*relayutil.JWTConfig{{JWKSURL: issuer.JWKSServer.URL}, {JWKSFile: jwksFile}} {
+		cf := NewTestConfig()
+		jwtConfig.Issuer = "https://issuer.test"
+		jwtConfig.Audience = "rpc-relay"
+		jwtConfig.ClaimPolicies = []*relayutil.JWTClaimPolicy{
+			{Claim: "scope", Value: "relay:calc", AllowedRPCMethods: map[string][]string{"calculateSum": {"*"}}},
+		}
+		cf.Ingress.Auth = &relayutil.AuthConfig{
+			APIKeys: []*relayutil.APIKey{
+				{Name: "team", Key: "team-key", AllowedRPCMethods: map[string][]string{"calculateSum": {"calculateSum"}}},
+			},
+			JWT: jwtConfig,
+		}
+		fixture := NewRelayFixture(t, cf)
+
+		nc, err := nats.Connect(cf.NATS.ServerURL)
+		assert.NoError(t, err)
+		sub, err := nc.SubscribeSync(cf.NATS.GetSubjectName("calculateSum", "calculateSum"))
+		assert.NoError(t, err)
+
+		for _, token := range []string{
+			issuer.Sign(t, "RS256", "rsa", newClaims()),
+			issuer.Sign(t, "ES256", "ec", newClaims()),
+			// Every key is tried for tokens without a key id
+			issuer.Sign(t, "ES256", "", newClaims()),
+		} {
+			httpResp, errCode := postWithHeaders(t, cf, calcSum, bearer(token))
+			assert.Equal(t, http.StatusOK, httpResp.StatusCode)
+			assert.Zero(t, errCode)
+
+			// The caller is passed to egress
+			msg, err := sub.NextMsg(time.Second)
+			if assert.NoError(t, err) {
+				assert.Equal(t, "service-a", egress.GetCaller(msg))
+			}
+		}
+
+		// API keys are still accepted as bearer tokens
+		httpResp, _ := postWithHeaders(t, cf, calcSum, bearer("team-key"))
+		assert.Equal(t, http.StatusOK, httpResp.StatusCode)
+
+		for name, token := range map[string]string{
+			"expired":       issuer.Sign(t, "RS256", "rsa", withClaim("exp", time.Now().Add(-time.Minute).Unix())),
+			"no expiration": issuer.Sign(t, "RS256", "rsa", withClaim("exp", nil)),
+			"not yet valid": issuer.Sign(t, "RS256", "rsa", withClaim("nbf", time.Now().Add(time.Minute).Unix())),
+			"issuer":        issuer.Sign(t, "RS256", "rsa", withClaim("iss", "https://other.test")),
+			"audience":      issuer.Sign(t, "RS256", "rsa", withClaim("aud", "other")),
+			"no subject":    issuer.Sign(t, "RS256", "rsa", withClaim("sub", nil)),
+			"unknown key":   issuer.Sign(t, "RS256", "unknown", newClaims()),
+			"wrong key":     issuer.Sign(t, "RS256", "ec", newClaims()),
+			"algorithm":     issuer.Sign(t, "HS256", "rsa", newClaims()),
+			"tampered":      strings.Replace(issuer.Sign(t, "RS256", "rsa", newClaims()), ".", ".e30", 1),
+		} {
+			httpResp, errCode := postWithHeaders(t, cf, calcSum, bearer(token))
+			assert.Equal(t, http.StatusUnauthorized, httpResp.StatusCode, name)
+			assert.Equal(t, egress.RPCErrorNum(egress.RPCErrorUnauthorized), errCode, name)
+		}
+
+		// Tokens without a matching claim policy can't call anything
+		httpResp, errCode := postWithHeaders(t, cf, calcSum,
+			bearer(issuer.Sign(t, "RS256", "rsa", withClaim("scope", "openid"))))
+		assert.Equal(t, http.StatusForbidden, httpResp.StatusCode)
+		assert.Equal(t, egress.RPCErrorNum(egress.RPCErrorForbidden), errCode)
+
+		nc.Close()
+		fixture.Shutdown()
+	}
+
+	// The JWKS is fetched once at startup, tokens with unknown keys don't cause a refetch right away
+	assert.Equal(t, int32(1), atomic.LoadInt32(&issuer.JWKSRequests))
+}
+
+func TestIngressJWTAuthSlowJWKSRefresh(t *testing.T) {
+	issuer := NewTestJWTIssuer(t)
+	cf := NewTestConfig()
+	cf.Ingress.Auth = &relayutil.AuthConfig{
+		JWT: &relayutil.JWTConfig{
+			JWKSURL:           issuer.JWKSServer.URL,
+			JWKSRefreshPeriod: 0.1,
+			ClaimPolicies: []*relayutil.JWTClaimPolicy{
+				{Claim: "sub", Value: "service-a", AllowedRPCMethods: map[string][]string{"calculateSum": {"*"}}},
+			},
+		},
+	}
+	fixture := NewRelayFixture(t, cf)
+	defer fixture.Shutdown()
+
+	atomic.StoreInt64(&issuer.JWKSDelay, int64(time.Second))
+	time.Sleep(150 * time.Millisecond)
+	token := issuer.Sign(t, "RS256", "rsa", map[string]any{
+		"sub": "service-a",
+		"exp": time.Now().Add(time.Minute).Unix(),
+	})
+	calcSum := `{"jsonrpc": "2.0", "id": 1, "method": "calculateSum_calculateSum", "params": [1, 2]}`
+
+	// Stale keys are refreshed in the background, tokens signed with known keys don't wait for it
+	for i := 0; i < 2; i++ {
+		start := time.Now()
+		httpResp, errCode := postWithHeaders(t, cf, calcSum, map[string]string{"Authorization": "Bearer " + token})
+		assert.Equal(t, http.StatusOK, httpResp.StatusCode)
+		assert.Zero(t, errCode)
+		assert.Less(t, time.Since(start), 500*time.Millisecond)
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&issuer.JWKSRequests))
+}
+
+func TestIngressJWTAuthKeysWithoutKid(t *testing.T) {
+	issuer := NewTestJWTIssuer(t)
+	var jwks struct {
+		Keys []map[string]string `json:"keys"`
+	}
+	assert.NoError(t, json.Unmarshal(issuer.JWKS(), &jwks))
+	for _, key := range jwks.Keys {
+		delete(key, "kid")
+	}
+	data, err := json.Marshal(jwks)
+	assert.NoError(t, err)
+	jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+	assert.NoError(t, os.WriteFile(jwksFile, data, 0600))
+
+	cf := NewTestConfig()
+	cf.Ingress.Auth = &relayutil.AuthConfig{
+		JWT: &relayutil.JWTConfig{
+			JWKSFile: jwksFile,
+			ClaimPolicies: []*relayutil.JWTClaimPolicy{
+				{Claim: "sub", Value: "service-a", AllowedRPCMethods: map[string][]string{"calculateSum": {"*"}}},
+			},
+		},
+	}
+	fixture := NewRelayFixture(t, cf)
+	defer fixture.Shutdown()
+	claims := map[string]any{"sub": "service-a", "exp": time.Now().Add(time.Minute).Unix()}
+	calcSum := `{"jsonrpc": "2.0", "id": 1, "method": "calculateSum_calculateSum", "params": [1, 2]}`
+
+	// Keys without a key id don't replace each other
+	for _, alg := range []string{"RS256", "ES256"} {
+		httpResp, errCode := postWithHeaders(t, cf, calcSum,
+			map[string]string{"Authorization": "Bearer " + issuer.Sign(t, alg, "", claims)})
+		assert.Equal(t, http.StatusOK, httpResp.StatusCode, alg)
+		assert.Zero(t, errCode)
+	}
+	// Tokens with a key id are not checked against keys without one
+	httpResp, errCode := postWithHeaders(t, cf, calcSum,
+		map[string]string{"Authorization": "Bearer " + issuer.Sign(t, "RS256", "rsa", claims)})
+	assert.Equal(t, http.StatusUnauthorized, httpResp.StatusCode)
+	assert.Equal(t, egress.RPCErrorNum(egress.RPCErrorUnauthorized), errCode)
+}
+
+func TestMemoryRateLimiter(t *testing.T) {
+	limiter := ingress.NewMemoryRateLimiter()
+	limit := &relayutil.RateLimit{Rate: 1, Burst: 2}
+
+	for i := 0; i < 2; i++ {
+		status, err := limiter.Take("client", limit, 1)
+		assert.NoError(t, err)
+		assert.True(t, status.Allowed)
+		assert.Equal(t, 2, status.Limit)
+		assert.Equal(t, 1-i, status.Remaining)
+	}
+	status, err := limiter.Take("client", limit, 1)
+	assert.NoError(t, err)
+	assert.False(t, status.Allowed)
+	assert.False(t, status.QuotaExceeded)
+	assert.InDelta(t, time.Second, status.RetryAfter, float64(100*time.Millisecond))
+	assert.InDelta(t, 2*time.Second, status.Reset, float64(100*time.Millisecond))
+
+	// Buckets are separate
+	status, err = limiter.Take("other", limit, 1)
+	assert.NoError(t, err)
+	assert.True(t, status.Allowed)
+
+	quota := &relayutil.RateLimit{DailyQuota: 2}
+	for i := 0; i < 2; i++ {
+		status, err = limiter.Take("quota", quota, 1)
+		assert.NoError(t, err)
+		assert.True(t, status.Allowed)
+		assert.Zero(t, status.Limit)
+		assert.Equal(t, 1-i, status.QuotaRemaining)
+	}
+	status, err = limiter.Take("quota", quota, 1)
+	assert.NoError(t, err)
+	assert.False(t, status.Allowed)
+	assert.True(t, status.QuotaExceeded)
+	assert.LessOrEqual(t, status.RetryAfter, 24*time.Hour)
+	assert.Equal(t, status.QuotaReset, status.RetryAfter)
+}
+
+func TestMemoryRateLimiter_Costs(t *testing.T) {
+	limiter := ingress.NewMemoryRateLimiter()
+	limit := &relayutil.RateLimit{Rate: 1, Burst: 10}
+
+	status, err := limiter.Take("client", limit, 4)
+	assert.NoError(t, err)
+	assert.True(t, status.Allowed)
+	assert.Equal(t, 6, status.Remaining)
+	// Calls are only allowed if the bucket has enough tokens for their cost
+	status, err = limiter.Take("client", limit, 7)
+	assert.NoError(t, err)
+	assert.False(t, status.Allowed)
+	assert.Equal(t, 6, status.Remaining)
+	assert.InDelta(t, time.Second, status.RetryAfter, float64(100*time.Millisecond))
+	status, err = limiter.Take("client", limit, 6)
+	assert.NoError(t, err)
+	assert.True(t, status.Allowed)
+	assert.Equal(t, 0, status.Remaining)
+
+	// Calls which cost more than the bucket size are allowed when the bucket is full and leave it in debt
+	status, err = limiter.Take("big", limit, 15)
+	assert.NoError(t, err)
+	assert.True(t, status.Allowed)
+	assert.Equal(t, 0, status.Remaining)
+	assert.InDelta(t, 15*time.Second, status.Reset, float64(100*time.Millisecond))
+	status, err = limiter.Take("big", limit, 1)
+	assert.NoError(t, err)
+	assert.False(t, status.Allowed)
+	assert.InDelta(t, 6*time.Second, status.RetryAfter, float64(100*time.Millisecond))
+
+	// Charges are taken regardless of the limit
+	_, err = limiter.Take("charged", limit, 1)
+	assert.NoError(t, err)
+	status, err = limiter.Charge("charged", limit, 20)
+	assert.NoError(t, err)
+	assert.True(t, status.Allowed)
+	assert.Equal(t, 0, status.Remaining)
+	status, err = limiter.Take("charged", limit, 1)
+	assert.NoError(t, err)
+	assert.False(t, status.Allowed)
+	assert.InDelta(t, 12*time.Second, status.RetryAfter, float64(100*time.Millisecond))
+
+	// Quotas count the costs, the last call of the day may exceed the quota
+	quota := &relayutil.RateLimit{DailyQuota: 5}
+	status, err = limiter.Take("quota", quota, 3)
+	assert.NoError(t, err)
+	assert.True(t, status.Allowed)
+	assert.Equal(t, 2, status.QuotaRemaining)
+	status, err = limiter.Take("quota", quota, 3)
+	assert.NoError(t, err)
+	assert.True(t, status.Allowed)
+	assert.Equal(t, 0, status.QuotaRemaining)
+	status, err = limiter.Take("quota", quota, 1)
+	assert.NoError(t, err)
+	assert.True(t, status.QuotaExceeded)
+}
+
+func TestIngressRateLimit(t *testing.T) {
+	cf := NewTestConfig()
+	cf.Ingress.RateLimit = &relayutil.RateLimitConfig{
+		ClientKey:    relayutil.RateLimitClientKeyHeader,
+		ClientHeader: "X-Client-ID",
+		Default:      &relayutil.RateLimit{Rate: 0.01, Burst: 2},
+		Policies: map[string]*relayutil.RateLimit{
+			"calculateSum_calculateSum": {DailyQuota: 3},
+		},
+	}
+	cf.JRPCServer.EnabledRPCModules["reverseString"] = []string{"reverseString"}
+	fixture := NewRelayFixture(t, cf)
+	defer fixture.Shutdown()
+
+	reverseString := `{"jsonrpc": "2.0", "id": 1, "method": "reverseString_reverseString", "params": ["abc"]}`
+	client := map[string]string{"X-Client-ID": "client", "Cache-Control": "no-cache"}
+	for i := 0; i < 2; i++ {
+		httpResp, errCode := postWithHeaders(t, cf, reverseString, client)
+		assert.Equal(t, http.StatusOK, httpResp.StatusCode)
+		assert.Zero(t, errCode)
+		assert.Equal(t, "2", httpResp.Header.Get("X-RateLimit-Limit"))
+		assert.Equal(t, strconv.Itoa(1-i), httpResp.Header.Get("X-RateLimit-Remaining"))
+		assert.NotEmpty(t, httpResp.Header.Get("X-RateLimit-Reset"))
+	}
+	httpResp, errCode := postWithHeaders(t, cf, reverseString, client)
+	assert.Equal(t, http.StatusTooManyRequests, httpResp.StatusCode)
+	assert.Equal(t, egress.RPCErrorNum(egress.RPCErrorRateLimited), errCode)
+	assert.Equal(t, "100", httpResp.Header.Get("Retry-After"))
+	assert.Equal(t, "0", httpResp.Header.Get("X-RateLimit-Remaining"))
+
+	// Clients have to back off in the jsonrpc status mode as well
+	cf.Ingress.HTTPStatusMode = relayutil.HTTPStatusModeJSONRPC
+	httpResp, errCode = postWithHeaders(t, cf, reverseString, client)
+	assert.Equal(t, http.StatusTooManyRequests, httpResp.StatusCode)
+	assert.Equal(t, egress.RPCErrorNum(egress.RPCErrorRateLimited), errCode)
+	cf.Ingress.HTTPStatusMode = relayutil.HTTPStatusModeREST
+
+	// Other clients have their own limits
+	httpResp, _ = postWithHeaders(t, cf, reverseString, map[string]string{"X-Client-ID": "other"})
+	assert.Equal(t, http.StatusOK, httpResp.StatusCode)
+
+	// Limited calls of a batch get error responses
+	batchReq, err := http.NewRequest(http.MethodPost, "http://"+cf.Ingress.GetHostWithPort(),
+		bytes.NewBufferString(`[`+reverseString+`, {"jsonrpc": "2.0", "id": 2, "method": "calculateSum_calculateSum", "params": [2, 2]}]`))
+	assert.NoError(t, err)
+	batchReq.Header.Set("X-Client-ID", "client")
+	batchResp, err := http.DefaultClient.Do(batchReq)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, batchResp.StatusCode)
+	var batch []json.RawMessage
+	assert.NoError(t, json.NewDecoder(batchResp.Body).Decode(&batch))
+	if assert.Len(t, batch, 2) {
+		assert.JSONEq(t, `{"jsonrpc":"2.0","id":1,"error":{"code":105,"message":"rate limit exceeded"}}`, string(batch[0]))
+		assert.JSONEq(t, `{"jsonrpc":"2.0","id":2,"result":4}`, string(batch[1]))
+	}
+
+	// The method policy only has a quota, one call of which was made in the batch
+	calcSum := `{"jsonrpc": "2.0", "id": 1, "method": "calculateSum_calculateSum", "params": [1, 2]}`
+	for i := 1; i < 3; i++ {
+		httpResp, errCode = postWithHeaders(t, cf, calcSum, client)
+		assert.Equal(t, http.StatusOK, httpResp.StatusCode)
+		assert.Zero(t, errCode)
+		assert.Equal(t, "3", httpResp.Header.Get("X-RateLimit-Quota-Limit"))
+		assert.Equal(t, strconv.Itoa(2-i), httpResp.Header.Get("X-RateLimit-Quota-Remaining"))
+		assert.Empty(t, httpResp.Header.Get("X-RateLimit-Limit"))
+	}
+	httpResp, errCode = postWithHeaders(t, cf, calcSum, client)
+	assert.Equal(t, http.StatusTooManyRequests, httpResp.StatusCode)
+	assert.Equal(t, egress.RPCErrorNum(egress.RPCErrorQuotaExceeded), errCode)
+	assert.Equal(t, httpResp.Header.Get("X-RateLimit-Quota-Reset"), httpResp.Header.Get("Retry-After"))
+}
+
+func TestIngressRateLimitExemptCacheHits(t *testing.T) {
+	cf := NewTestConfig()
+	cf.Ingress.RateLimit = &relayutil.RateLimitConfig{
+		Default:         &relayutil.RateLimit{Rate: 0.01, Burst: 1},
+		ExemptCacheHits: true,
+	}
+	fixture := NewRelayFixture(t, cf)
+	defer fixture.Shutdown()
+
+	for i := 0; i < 3; i++ {
+		httpResp, resp := postCalcSum(t, cf, nil)
+		assert.Equal(t, http.StatusOK, httpResp.StatusCode)
+		assert.Equal(t, 3, resp.Result)
+	}
+
+	// A call which is not in the cache is limited
+	httpResp, errCode := postWithHeaders(t, cf,
+		`{"jsonrpc": "2.0", "id": 1, "method": "calculateSum_calculateSum", "params": [2, 2]}`, nil)
+	assert.Equal(t, http.StatusTooManyRequests, httpResp.StatusCode)
+	assert.Equal(t, egress.RPCErrorNum(egress.RPCErrorRateLimited), errCode)
+}
+
+func TestIngressRateLimitRejectedCalls(t *testing.T) {
+	cf := NewTestConfig()
+	cf.Ingress.Auth = &relayutil.AuthConfig{
+		APIKeys: []*relayutil.APIKey{
+			{Name: "team", Key: "team-key", AllowedRPCMethods: map[string][]string{"calculateSum": {"calculateSum"}}},
+		},
+	}
+	cf.Ingress.RateLimit = &relayutil.RateLimitConfig{
+		Default:         &relayutil.RateLimit{Rate: 0.01, Burst: 2},
+		ExemptCacheHits: true,
+	}
+	cf.JRPCServer.EnabledRPCModules["reverseString"] = []string{"reverseString"}
+	fixture := NewRelayFixture(t, cf)
+	defer fixture.Shutdown()
+	apiKey := map[string]string{"X-API-Key": "team-key"}
+
+	// Calls rejected by ingress are counted even though cache hits are not
+	httpResp, errCode := postWithHeaders(t, cf,
+		`{"jsonrpc": "2.0", "id": 1, "method": "reverseString_reverseString", "params": ["abc"]}`, apiKey)
+	assert.Equal(t, http.StatusForbidden, httpResp.StatusCode)
+	assert.Equal(t, egress.RPCErrorNum(egress.RPCErrorForbidden), errCode)
+	assert.Equal(t, "1", httpResp.Header.Get("X-RateLimit-Remaining"))
+
+	httpResp, errCode = postWithHeaders(t, cf,
+		`{"jsonrpc": "2.0", "id": 1, "method": "calculateSum_calculateSum", "params": {"c": 1}}`, apiKey)
+	assert.Equal(t, http.StatusBadRequest, httpResp.StatusCode)
+	assert.Equal(t, egress.RPCErrorNum(egress.RPCErrorInvalidParams), errCode)
+	assert.Equal(t, "0", httpResp.Header.Get("X-RateLimit-Remaining"))
+
+	httpResp, errCode = postWithHeaders(t, cf,
+		`{"jsonrpc": "2.0", "id": 1, "method": "calculateSum_calculateSum", "params": [1, 2]}`, apiKey)
+	assert.Equal(t, http.StatusTooManyRequests, httpResp.StatusCode)
+	assert.Equal(t, egress.RPCErrorNum(egress.RPCErrorRateLimited), errCode)
+}
+
+func TestIngressRateLimitCosts(t *testing.T) {
+	cf := NewTestConfig()
+	cf.Ingress.RateLimit = &relayutil.RateLimitConfig{
+		ClientKey:    relayutil.RateLimitClientKeyHeader,
+		ClientHeader: "X-Client-ID",
+		Default:      &relayutil.RateLimit{Rate: 0.01, Burst: 10},
+		Policies: map[string]*relayutil.RateLimit{
+			"reverseString": {Rate: 0.01, Burst: 10},
+		},
+		Costs: map[string]*relayutil.RPCMethodCost{
+			"reverseString": {PerRequestKiB: 1, PerResponseKiB: 1},
+		},
+	}
+	cf.JRPCServer.EnabledRPCModules["reverseString"] = []string{"reverseString"}
+	fixture := NewRelayFixture(t, cf)
+	defer fixture.Shutdown()
+
+	client := map[string]string{"X-Client-ID": "client", "Cache-Control": "no-cache"}
+	// About 5 tokens are taken for the call with 4KiB of params and 4 more for the response
+	bigString := `{"jsonrpc": "2.0", "id": 1, "method": "reverseString_reverseString", "params": ["` +
+		strings.Repeat("a", 4096) + `"]}`
+	httpResp, errCode := postWithHeaders(t, cf, bigString, client)
+	assert.Equal(t, http.StatusOK, httpResp.StatusCode)
+	assert.Zero(t, errCode)
+	assert.Equal(t, "10", httpResp.Header.Get("X-RateLimit-Limit"))
+	assert.Equal(t, "0", httpResp.Header.Get("X-RateLimit-Remaining"))
+
+	smallString := `{"jsonrpc": "2.0", "id": 1, "method": "reverseString_reverseString", "params": ["abc"]}`
+	httpResp, errCode = postWithHeaders(t, cf, smallString, client)
+	assert.Equal(t, http.StatusTooManyRequests, httpResp.StatusCode)
+	assert.Equal(t, egress.RPCErrorNum(egress.RPCErrorRateLimited), errCode)
+
+	// Cheap methods have their own budget
+	calcSum := `{"jsonrpc": "2.0", "id": 1, "method": "calculateSum_calculateSum", "params": [1, 2]}`
+	httpResp, errCode = postWithHeaders(t, cf, calcSum, client)
+	assert.Equal(t, http.StatusOK, httpResp.StatusCode)
+	assert.Zero(t, errCode)
+	assert.Equal(t, "9", httpResp.Header.Get("X-RateLimit-Remaining"))
+}
@@ -41,14 +41,15 @@ func TestJRPCServerHandleBadCalls(t *testing.T) {
 	defer fixture.Shutdown()
 
 	data := [][]byte{
-		[]byte(`{"jsonrpc": "2.0", "method": "dummyModule_dummyMethod", "params": [1,2]}`),
 		[]byte(`{"id": null, "method": "dummyModule_dummyMethod", "params": [1,2]}`),
 		[]byte(`{"id": 1, "jsonrpc": "1.0", "method": "dummyModule_dummyMethod", "params": [1,2]}`),
 		[]byte(`{"id": 1, "jsonrpc": "2.0", "method": "dummyModuledummyMethod", "params": [1,2]}`),
 		[]byte(`{"jsonrpc": "2.0", "id": 1, "method": "calculateSum_calculateSum", "params": ["1", 2]}`),
 	}
+	// Error responses are addressed to the id of the request if it has a valid one
+	ids := []any{nil, float64(1), float64(1), float64(1)}
 
-	for _, v := range data {
+	for i, v := range data {
 		resp, err := http.Post(
 			"http://"+cf.Ingress.GetHostWithPort(), "application/json", bytes.NewBuffer(v))
 		assert.NoError(t, err)
@@ -59,7 +60,7 @@ func TestJRPCServerHandleBadCalls(t *testing.T) {
 		assert.NotNil(t, response.Error)
 		assert.NotNil(t, response.Error.Code)
 		assert.NotNil(t, response.Error.Message)
-		assert.Nil(t, response.ID)
+		assert.Equal(t, ids[i], response.ID)
 		assert.Equal(t, response.JSONRPC, "2.0")
 	}
 }
@@ -0,0 +1,128 @@
+package servertests
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/nats-io/nats.go"
+	"github.com/parkanaur/rpc-relay/pkg/egress"
+	"github.com/parkanaur/rpc-relay/pkg/ingress"
+	"github.com/parkanaur/rpc-relay/pkg/relayutil"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func NewTestNATSCacheConfig() *relayutil.Config {
+	cf := NewTestConfig()
+	cf.Ingress.CacheBackend = ingress.CacheBackendNATS
+	cf.Ingress.NATSKeyValue = &relayutil.NATSKeyValueConfig{BucketName: "rpcCache"}
+	return cf
+}
+
+func TestNATSCache_New(t *testing.T) {
+	cf := NewTestNATSCacheConfig()
+	_, conns := ConnectTestNATSServer(t, cf, 1)
+
+	cache, err := ingress.NewCache(cf, conns[0])
+	assert.NoError(t, err)
+	assert.IsType(t, &ingress.NATSCache{}, cache)
+
+	// Existing bucket is reused
+	_, err = ingress.NewNATSCache(cf, conns[0])
+	assert.NoError(t, err)
+
+	cf.Ingress.NATSKeyValue = nil
+	_, err = ingress.NewCache(cf, conns[0])
+	assert.Error(t, err)
+}
+
+func TestNATSCache_AddGetRemove(t *testing.T) {
+	cf := NewTestNATSCacheConfig()
+	_, conns := ConnectTestNATSServer(t, cf, 1)
+	cache, err := ingress.NewNATSCache(cf, conns[0])
+	assert.NoError(t, err)
+
+	request := NewRPCCalcRequest(append(make([]any, 0), 1, "2"))
+	cache.Add(request, &egress.RPCRawResponse{JSONRPC: "2.0", ID: 1, Result: json.RawMessage("3")})
+
+	cachedRequest, ok := cache.GetRequestByKey(request.GetRequestKey())
+	assert.True(t, ok)
+	assert.Equal(t, request.GetRequestKey(), cachedRequest.Request.GetRequestKey())
+	assert.Equal(t, "3", string(cachedRequest.Response.Result))
+	assert.Nil(t, cachedRequest.Response.ID)
+
+	assert.NoError(t, cache.RemoveByKey(request.GetRequestKey()))
+	assert.Error(t, cache.RemoveByKey(request.GetRequestKey()))
+	_, ok = cache.GetRequestByKey(request.GetRequestKey())
+	assert.False(t, ok)
+}
+
+func TestNATSCache_SharedBetweenReplicas(t *testing.T) {
+	cf := NewTestNATSCacheConfig()
+	_, conns := ConnectTestNATSServer(t, cf, 2)
+
+	caches := make([]*ingress.NATSCache, 0)
+	for _, nc := range conns {
+		cache, err := ingress.NewNATSCache(cf, nc)
+		assert.NoError(t, err)
+		caches = append(caches, cache)
+	}
+
+	request := NewRPCCalcRequest(append(make([]any, 0), 1, 2))
+	caches[0].Add(request, &egress.RPCRawResponse{JSONRPC: "2.0", Result: json.RawMessage("3")})
+	cachedRequest, ok := caches[1].GetRequestByKey(request.GetRequestKey())
+	assert.True(t, ok)
+	assert.Equal(t, "3", string(cachedRequest.Response.Result))
+}
+
+func TestNATSCache_Expire(t *testing.T) {
+	cf := NewTestNATSCacheConfig()
+	cf.Ingress.ExpireCachedRequestThreshold = 0.1
+	_, conns := ConnectTestNATSServer(t, cf, 1)
+	cache, err := ingress.NewNATSCache(cf, conns[0])
+	assert.NoError(t, err)
+
+	request := NewRPCCalcRequest(append(make([]any, 0), 1, 2))
+	cache.Add(request, &egress.RPCRawResponse{JSONRPC: "2.0", Result: json.RawMessage("3")})
+	_, ok := cache.GetRequestByKey(request.GetRequestKey())
+	assert.True(t, ok)
+
+	time.Sleep(200 * time.Millisecond)
+	_, ok = cache.GetRequestByKey(request.GetRequestKey())
+	assert.False(t, ok)
+}
+
+func TestIngressNATSCache(t *testing.T) {
+	cf := NewTestNATSCacheConfig()
+	fixture := NewRelayFixture(t, cf)
+	defer fixture.Shutdown()
+
+	nc, err := nats.Connect(cf.NATS.ServerURL)
+	assert.NoError(t, err)
+	defer nc.Close()
+	sub, err := nc.SubscribeSync(cf.NATS.GetSubjectName("calculateSum", "calculateSum"))
+	assert.NoError(t, err)
+
+	// The second call is served from the bucket with its own id
+	for id, cacheStatus := range []string{ingress.CacheStatusMiss, ingress.CacheStatusHit} {
+		httpResp, _ := postWithHeaders(t, cf, fmt.Sprintf(
+			`{"jsonrpc": "2.0", "id": %d, "method": "calculateSum_calculateSum", "params": [1, 2]}`, id), nil)
+		var resp RPCCalcSumResponse
+		assert.NoError(t, json.NewDecoder(httpResp.Body).Decode(&resp))
+		assert.Equal(t, RPCCalcSumResponse{JSONRPC: "2.0", Result: 3, ID: id}, resp)
+		assert.Equal(t, cacheStatus, httpResp.Header.Get("X-Cache"))
+	}
+
+	_, err = sub.NextMsg(time.Second)
+	assert.NoError(t, err)
+	_, err = sub.NextMsg(100 * time.Millisecond)
+	assert.ErrorIs(t, err, nats.ErrTimeout)
+
+	js, err := nc.JetStream()
+	assert.NoError(t, err)
+	kv, err := js.KeyValue(cf.Ingress.NATSKeyValue.BucketName)
+	assert.NoError(t, err)
+	keys, err := kv.Keys()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(keys))
+}
@@ -0,0 +1,140 @@
+package servertests
+
+import (
+	natsserver "github.com/nats-io/nats-server/v2/server"
+	"github.com/parkanaur/rpc-relay/pkg/ingress"
+	"github.com/parkanaur/rpc-relay/pkg/relayutil"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func NewTestNATSRateLimitConfig() *relayutil.RateLimitConfig {
+	return &relayutil.RateLimitConfig{
+		Backend:      ingress.RateLimitBackendNATS,
+		NATSKeyValue: &relayutil.NATSKeyValueConfig{BucketName: "rpcRateLimits"},
+	}
+}
+
+func TestNATSRateLimiter_New(t *testing.T) {
+	_, conns := ConnectTestNATSServer(t, NewTestConfig(), 1)
+	nc := conns[0]
+
+	cf := NewTestNATSRateLimitConfig()
+	limiter, err := ingress.NewRateLimiter(cf, nc)
+	assert.NoError(t, err)
+	assert.IsType(t, &ingress.NATSRateLimiter{}, limiter)
+
+	// Existing bucket is reused
+	_, err = ingress.NewNATSRateLimiter(cf, nc)
+	assert.NoError(t, err)
+
+	cf.NATSKeyValue = nil
+	_, err = ingress.NewRateLimiter(cf, nc)
+	assert.Error(t, err)
+
+	limiter, err = ingress.NewRateLimiter(&relayutil.RateLimitConfig{}, nc)
+	assert.NoError(t, err)
+	assert.IsType(t, &ingress.MemoryRateLimiter{}, limiter)
+
+	_, err = ingress.NewRateLimiter(&relayutil.RateLimitConfig{Backend: "unknown"}, nc)
+	assert.Error(t, err)
+}
+
+// newTestNATSRateLimiters starts a NATS server and creates rate limiters of several ingress replicas sharing
+// the key-value bucket
+func newTestNATSRateLimiters(t *testing.T, replicas int) (*natsserver.Server, []*ingress.NATSRateLimiter) {
+	srv, conns := ConnectTestNATSServer(t, NewTestConfig(), replicas)
+	limiters := make([]*ingress.NATSRateLimiter, 0, replicas)
+	for _, nc := range conns {
+		limiter, err := ingress.NewNATSRateLimiter(NewTestNATSRateLimitConfig(), nc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		limiters = append(limiters, limiter)
+	}
+	return srv, limiters
+}
+
+func TestNATSRateLimiter_SharedBetweenReplicas(t *testing.T) {
+	_, limiters := newTestNATSRateLimiters(t, 2)
+	limit := &relayutil.RateLimit{Rate: 0.01, Burst: 3, DailyQuota: 10}
+
+	for i := 0; i < 3; i++ {
+		status, err := limiters[i%2].Take("client", limit, 1)
+		assert.NoError(t, err)
+		assert.True(t, status.Allowed)
+		assert.Equal(t, 2-i, status.Remaining)
+		assert.Equal(t, 9-i, status.QuotaRemaining)
+	}
+	for _, limiter := range limiters {
+		status, err := limiter.Take("client", limit, 1)
+		assert.NoError(t, err)
+		assert.False(t, status.Allowed)
+		assert.False(t, limiter.IsFallingBack())
+	}
+}
+
+func TestNATSRateLimiter_Costs(t *testing.T) {
+	_, limiters := newTestNATSRateLimiters(t, 2)
+	limit := &relayutil.RateLimit{Rate: 0.01, Burst: 10}
+
+	status, err := limiters[0].Take("client", limit, 4)
+	assert.NoError(t, err)
+	assert.True(t, status.Allowed)
+	assert.Equal(t, 6, status.Remaining)
+	status, err = limiters[1].Charge("client", limit, 5.5)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, status.Remaining)
+	status, err = limiters[0].Take("client", limit, 1)
+	assert.NoError(t, err)
+	assert.False(t, status.Allowed)
+	assert.False(t, limiters[0].IsFallingBack())
+}
+
+func TestNATSRateLimiter_ConcurrentCalls(t *testing.T) {
+	_, limiters := newTestNATSRateLimiters(t, 2)
+	limit := &relayutil.RateLimit{Rate: 0.01, Burst: 10}
+
+	var allowed int32
+	wg := sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(limiter *ingress.NATSRateLimiter) {
+			defer wg.Done()
+			status, err := limiter.Take("client", limit, 1)
+			assert.NoError(t, err)
+			if status.Allowed {
+				atomic.AddInt32(&allowed, 1)
+			}
+		}(limiters[i%2])
+	}
+	wg.Wait()
+	assert.Equal(t, int32(10), allowed)
+}
+
+func TestNATSRateLimiter_Fallback(t *testing.T) {
+	jsSrv, limiters := newTestNATSRateLimiters(t, 1)
+	limiter := limiters[0]
+	limit := &relayutil.RateLimit{Rate: 0.01, Burst: 2}
+
+	status, err := limiter.Take("client", limit, 1)
+	assert.NoError(t, err)
+	assert.True(t, status.Allowed)
+
+	// The calls are counted locally while JetStream is unavailable
+	jsSrv.Shutdown()
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		status, err = limiter.Take("client", limit, 1)
+		assert.NoError(t, err)
+		assert.True(t, status.Allowed)
+		assert.True(t, limiter.IsFallingBack())
+	}
+	status, err = limiter.Take("client", limit, 1)
+	assert.NoError(t, err)
+	assert.False(t, status.Allowed)
+	assert.Less(t, time.Since(start), 2*time.Second)
+}
@@ -0,0 +1,122 @@
+package servertests
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/parkanaur/rpc-relay/pkg/egress"
+	"github.com/parkanaur/rpc-relay/pkg/ingress"
+	"github.com/parkanaur/rpc-relay/pkg/relayutil"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func NewTestRedisConfig(t *testing.T) (*relayutil.Config, *miniredis.Miniredis) {
+	redisSrv := miniredis.RunT(t)
+	cf := NewTestConfig()
+	cf.Ingress.CacheBackend = ingress.CacheBackendRedis
+	cf.Ingress.Redis = &relayutil.RedisConfig{Address: redisSrv.Addr(), KeyPrefix: "relay:"}
+	return cf, redisSrv
+}
+
+func TestNewCache(t *testing.T) {
+	cf, _ := NewTestRedisConfig(t)
+	cache, err := ingress.NewCache(cf, nil)
+	assert.NoError(t, err)
+	assert.IsType(t, &ingress.RedisCache{}, cache)
+	cache.Stop()
+
+	cf.Ingress.CacheBackend = ""
+	cache, err = ingress.NewCache(cf, nil)
+	assert.NoError(t, err)
+	assert.IsType(t, &ingress.RequestCache{}, cache)
+
+	cf.Ingress.CacheBackend = "memcached"
+	_, err = ingress.NewCache(cf, nil)
+	assert.Error(t, err)
+
+	cf.Ingress.CacheBackend = ingress.CacheBackendRedis
+	cf.Ingress.Redis = nil
+	_, err = ingress.NewCache(cf, nil)
+	assert.Error(t, err)
+}
+
+func TestRedisCache_AddGetRemove(t *testing.T) {
+	cf, redisSrv := NewTestRedisConfig(t)
+	cache, err := ingress.NewRedisCache(cf)
+	assert.NoError(t, err)
+	defer cache.Stop()
+
+	request := NewRPCCalcRequest(append(make([]any, 0), 1, 2))
+	cache.Add(request, &egress.RPCRawResponse{JSONRPC: "2.0", ID: 1, Result: json.RawMessage("3")})
+
+	redisKey := cf.Ingress.Redis.KeyPrefix + request.GetRequestKey()
+	assert.True(t, redisSrv.Exists(redisKey))
+	assert.Equal(t, relayutil.GetDurationInSeconds(cf.Ingress.ExpireCachedRequestThreshold), redisSrv.TTL(redisKey))
+
+	cachedRequest, ok := cache.GetRequestByKey(request.GetRequestKey())
+	assert.True(t, ok)
+	assert.Equal(t, request.GetRequestKey(), cachedRequest.Request.GetRequestKey())
+	assert.Equal(t, request.ModuleName, cachedRequest.Request.ModuleName)
+	assert.Equal(t, "3", string(cachedRequest.Response.Result))
+	assert.Nil(t, cachedRequest.Response.ID)
+	assert.False(t, cachedRequest.IsRequestStale(time.Second))
+
+	assert.NoError(t, cache.RemoveByKey(request.GetRequestKey()))
+	assert.Error(t, cache.RemoveByKey(request.GetRequestKey()))
+	_, ok = cache.GetRequestByKey(request.GetRequestKey())
+	assert.False(t, ok)
+}
+
+func TestRedisCache_Expire(t *testing.T) {
+	cf, redisSrv := NewTestRedisConfig(t)
+	cf.Ingress.StaleIfErrorThreshold = 5.0
+	cache, err := ingress.NewRedisCache(cf)
+	assert.NoError(t, err)
+	defer cache.Stop()
+
+	request := NewRPCCalcRequest(append(make([]any, 0), 1, 2))
+	cache.Add(request, &egress.RPCRawResponse{JSONRPC: "2.0", Result: json.RawMessage("3")})
+
+	// Expired requests are kept for the stale-if-error period
+	redisSrv.FastForward(relayutil.GetDurationInSeconds(cf.Ingress.ExpireCachedRequestThreshold) + time.Second)
+	_, ok := cache.GetRequestByKey(request.GetRequestKey())
+	assert.True(t, ok)
+
+	redisSrv.FastForward(relayutil.GetDurationInSeconds(cf.Ingress.StaleIfErrorThreshold))
+	_, ok = cache.GetRequestByKey(request.GetRequestKey())
+	assert.False(t, ok)
+}
+
+func TestRedisCache_SharedBetweenReplicas(t *testing.T) {
+	cf, _ := NewTestRedisConfig(t)
+	firstCache, err := ingress.NewRedisCache(cf)
+	assert.NoError(t, err)
+	defer firstCache.Stop()
+	secondCache, err := ingress.NewRedisCache(cf)
+	assert.NoError(t, err)
+	defer secondCache.Stop()
+
+	request := NewRPCCalcRequest(append(make([]any, 0), 1, 2))
+	firstCache.Add(request, &egress.RPCRawResponse{JSONRPC: "2.0", Result: json.RawMessage("3")})
+	cachedRequest, ok := secondCache.GetRequestByKey(request.GetRequestKey())
+	assert.True(t, ok)
+	assert.Equal(t, "3", string(cachedRequest.Response.Result))
+}
+
+func TestIngressRedisCache(t *testing.T) {
+	cf, redisSrv := NewTestRedisConfig(t)
+	fixture := NewRelayFixture(t, cf)
+	defer fixture.Shutdown()
+
+	// The second call is served from the cache with its own id
+	for _, id := range []int{1, 2} {
+		httpResp, _ := postWithHeaders(t, cf, fmt.Sprintf(
+			`{"jsonrpc": "2.0", "id": %d, "method": "calculateSum_calculateSum", "params": [1, 2]}`, id), nil)
+		var resp RPCCalcSumResponse
+		assert.NoError(t, json.NewDecoder(httpResp.Body).Decode(&resp))
+		assert.Equal(t, RPCCalcSumResponse{JSONRPC: "2.0", Result: 3, ID: id}, resp)
+	}
+	assert.Equal(t, 1, len(redisSrv.Keys()))
+}
@@ -1,11 +1,12 @@
 package servertests
 
 import (
+	"encoding/json"
 	"github.com/parkanaur/rpc-relay/pkg/egress"
 	"github.com/parkanaur/rpc-relay/pkg/ingress"
 	"github.com/parkanaur/rpc-relay/pkg/relayutil"
 	"github.com/stretchr/testify/assert"
-	"sort"
+	"strconv"
 	"sync"
 	"testing"
 	"time"
@@ -37,7 +38,11 @@ func FillTestCache(cache *ingress.RequestCache, numRequests int) map[string]*egr
 	}
 	for key, request := range requests {
 		go func(key string, request *egress.RPCRequest) {
-			cache.Add(requests[key], []byte(key))
+			cache.Add(requests[key], &egress.RPCRawResponse{
+				JSONRPC: "2.0",
+				ID:      requests[key].ID,
+				Result:  json.RawMessage(strconv.Quote(key)),
+			})
 			wg.Done()
 		}(key, request)
 	}
@@ -150,28 +155,117 @@ func TestRequestCache_RemoveByValue(t *testing.T) {
 	assert.Equal(t, len(cache.Cache), 0)
 }
 
-func TestRequestCache_DeleteStaleValues(t *testing.T) {
+func TestRequestCache_DeleteExpiredValues(t *testing.T) {
 	cf := NewTestConfig()
-	egrFixture := NewRelayFixture(t, cf)
-	defer egrFixture.Shutdown()
-	cache := NewTestCache()
+	cache := ingress.NewRequestCache(cf)
 
-	requests := FillTestCache(cache, 5)
-	keys := make([]string, 0)
-	for k, _ := range requests {
-		keys = append(keys, k)
+	requests := make([]*egress.RPCRequest, 0)
+	for i := 0; i < 5; i++ {
+		requests = append(requests, NewRPCCalcRequest(append(make([]any, 0), i, i+1)))
 	}
-	sort.Strings(keys)
-	for i := 0; i < 3; i++ {
-		// Add() and Sub() have different parameter types - ???????????
-		cache.Cache[keys[i]].CTime = cache.Cache[keys[i]].CTime.Add(
-			-(relayutil.GetDurationInSeconds(cf.Ingress.ExpireCachedRequestThreshold) + time.Second*5))
+	response := &egress.RPCRawResponse{JSONRPC: "2.0", Result: json.RawMessage("1")}
+	for _, request := range requests[:3] {
+		cache.Add(request, response)
 	}
-	cache.DeleteStaleValues(relayutil.GetDurationInSeconds(cf.Ingress.ExpireCachedRequestThreshold))
+	time.Sleep(10 * time.Millisecond)
+	deadline := time.Now().Add(relayutil.GetDurationInSeconds(cf.Ingress.ExpireCachedRequestThreshold))
+	time.Sleep(10 * time.Millisecond)
+	for _, request := range requests[3:] {
+		cache.Add(request, response)
+	}
+	// Re-adding a request moves it to the end of the expiry queue
+	cache.Add(requests[0], response)
+
+	cache.DeleteExpiredValues(deadline)
 
-	assert.Equal(t, len(cache.Cache), 2)
-	for i := 3; i < 5; i++ {
-		_, contains := cache.GetRequestByKey(keys[i])
-		assert.True(t, contains)
+	assert.Equal(t, len(cache.Cache), 3)
+	for i, request := range requests {
+		_, contains := cache.GetRequestByValue(request)
+		assert.Equal(t, i == 0 || i >= 3, contains)
 	}
+
+	cache.DeleteExpiredValues(time.Now().Add(relayutil.GetDurationInSeconds(cf.Ingress.ExpireCachedRequestThreshold)))
+	assert.Equal(t, len(cache.Cache), 0)
+	assert.Equal(t, cache.Size(), 0)
+}
+
+func TestRequestCache_DeleteExpiredValuesBatches(t *testing.T) {
+	cf := NewTestConfig()
+	cache := ingress.NewRequestCache(cf)
+
+	response := &egress.RPCRawResponse{JSONRPC: "2.0", Result: json.RawMessage("1")}
+	for i := 0; i < 2500; i++ {
+		cache.Add(NewRPCCalcRequest(append(make([]any, 0), i, i+1)), response)
+	}
+	cache.DeleteExpiredValues(time.Now().Add(relayutil.GetDurationInSeconds(cf.Ingress.ExpireCachedRequestThreshold)))
+	assert.Equal(t, len(cache.Cache), 0)
+}
+
+func TestRequestCache_EvictLeastRecentlyUsed(t *testing.T) {
+	cf := NewTestConfig()
+	cf.Ingress.MaxCacheEntries = 3
+	cache := ingress.NewRequestCache(cf)
+
+	requests := make([]*egress.RPCRequest, 0)
+	for i := 0; i < 4; i++ {
+		requests = append(requests, NewRPCCalcRequest(append(make([]any, 0), i, i+1)))
+	}
+	response := &egress.RPCRawResponse{JSONRPC: "2.0", Result: json.RawMessage("1")}
+	for _, request := range requests[:3] {
+		cache.Add(request, response)
+	}
+	// The first request becomes the most recently used one, so the second one is evicted
+	_, ok := cache.GetRequestByValue(requests[0])
+	assert.True(t, ok)
+	cache.Add(requests[3], response)
+
+	assert.Equal(t, 3, len(cache.Cache))
+	assert.Equal(t, uint64(1), cache.Evictions())
+	_, ok = cache.GetRequestByValue(requests[1])
+	assert.False(t, ok)
+	for _, i := range []int{0, 2, 3} {
+		_, ok = cache.GetRequestByValue(requests[i])
+		assert.True(t, ok)
+	}
+}
+
+func TestRequestCache_EvictBySize(t *testing.T) {
+	cf := NewTestConfig()
+	cache := ingress.NewRequestCache(cf)
+
+	requests := make([]*egress.RPCRequest, 0)
+	for i := 0; i < 3; i++ {
+		requests = append(requests, NewRPCCalcRequest(append(make([]any, 0), i, i+1)))
+	}
+	response := &egress.RPCRawResponse{JSONRPC: "2.0", Result: json.RawMessage(`"0123456789"`)}
+	cache.Add(requests[0], response)
+	entrySize := cache.Size()
+
+	// Only two requests fit into the cache
+	cf.Ingress.MaxCacheBytes = entrySize * 2
+	cache.Add(requests[1], response)
+	cache.Add(requests[2], response)
+	assert.Equal(t, 2, len(cache.Cache))
+	assert.Equal(t, entrySize*2, cache.Size())
+	assert.Equal(t, uint64(1), cache.Evictions())
+	_, ok := cache.GetRequestByValue(requests[0])
+	assert.False(t, ok)
+
+	// Responses bigger than the limit are not cached at all
+	cache.Add(requests[0], &egress.RPCRawResponse{
+		JSONRPC: "2.0", Result: json.RawMessage(strconv.Quote(string(make([]byte, entrySize*2))))})
+	_, ok = cache.GetRequestByValue(requests[0])
+	assert.False(t, ok)
+	assert.Equal(t, 2, len(cache.Cache))
+
+	// So are requests with params bigger than the limit
+	bigRequest := NewRPCCalcRequest(append(make([]any, 0), string(make([]byte, entrySize*2)), 1))
+	cache.Add(bigRequest, response)
+	_, ok = cache.GetRequestByValue(bigRequest)
+	assert.False(t, ok)
+	assert.Equal(t, 2, len(cache.Cache))
+
+	err := cache.RemoveByValue(requests[1])
+	assert.NoError(t, err)
+	assert.Equal(t, entrySize, cache.Size())
 }
@@ -2,35 +2,136 @@ package servertests
 
 import (
 	"context"
-	gnatsd "github.com/nats-io/gnatsd/server"
-	natstest "github.com/nats-io/nats-server/test"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	natsserver "github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
 	"github.com/parkanaur/rpc-relay/pkg/egress"
 	"github.com/parkanaur/rpc-relay/pkg/ingress"
 	"github.com/parkanaur/rpc-relay/pkg/jrpcserver"
+	"github.com/parkanaur/rpc-relay/pkg/jrpcserver/services"
 	"github.com/parkanaur/rpc-relay/pkg/relayutil"
+	"math/big"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"strconv"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
-func StartTestNATSServer(t *testing.T, cf *relayutil.Config) *gnatsd.Server {
+// NullService is an RPC service for testing methods which return nothing or null
+type NullService struct {
+}
+
+const NullServiceName string = "null"
+
+// Nothing has no return value
+func (service *NullService) Nothing() error {
+	return nil
+}
+
+// Null returns null
+func (service *NullService) Null() (*int, error) {
+	return nil, nil
+}
+
+// ErrorService is an RPC service for testing error responses
+type ErrorService struct {
+}
+
+const ErrorServiceName string = "error"
+
+// testRPCError is an error with a JSON-RPC code and data
+type testRPCError struct {
+	code    int
+	message string
+	data    any
+}
+
+func (err *testRPCError) Error() string  { return err.message }
+func (err *testRPCError) ErrorCode() int { return err.code }
+func (err *testRPCError) ErrorData() any { return err.data }
+
+// Fail returns an application error
+func (service *ErrorService) Fail() error {
+	return &testRPCError{3, "application error", map[string]string{"reason": "test"}}
+}
+
+// Crash returns an internal error
+func (service *ErrorService) Crash() error {
+	return &testRPCError{-32603, "crash", "stack trace"}
+}
+
+// Plain returns an error without a code
+func (service *ErrorService) Plain() error {
+	return errors.New("secret detail")
+}
+
+func init() {
+	services.ServiceRegistry[NullServiceName] = func() interface{} { return &NullService{} }
+	services.ServiceRegistry[ErrorServiceName] = func() interface{} { return &ErrorService{} }
+}
+
+// StartTestNATSServer starts a NATS server at the address from the config. JetStream is enabled, so that
+// the server can be used by the key-value backends as well
+func StartTestNATSServer(t *testing.T, cf *relayutil.Config) *natsserver.Server {
 	u, err := url.ParseRequestURI(cf.NATS.ServerURL)
+	if err != nil {
+		t.Fatal(err)
+	}
 	host, portStr, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
 	port, err := strconv.Atoi(portStr)
-	opts := gnatsd.Options{
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv, err := natsserver.NewServer(&natsserver.Options{
 		Host:           host,
 		Port:           port,
 		NoLog:          true,
 		NoSigs:         true,
 		MaxControlLine: 256,
-	}
+		JetStream:      true,
+		StoreDir:       t.TempDir(),
+	})
 	if err != nil {
 		t.Fatal(err)
 	}
+	go srv.Start()
+	if !srv.ReadyForConnections(5 * time.Second) {
+		t.Fatal("NATS server is not ready")
+	}
+	return srv
+}
 
-	return natstest.RunServer(&opts)
+// ConnectTestNATSServer starts a NATS server at the address from the config and connects the given number
+// of clients to it, e.g. one per ingress replica. The clients and the server are closed at the end of the test
+func ConnectTestNATSServer(t *testing.T, cf *relayutil.Config, clients int) (*natsserver.Server, []*nats.Conn) {
+	srv := StartTestNATSServer(t, cf)
+	t.Cleanup(srv.Shutdown)
+	conns := make([]*nats.Conn, 0, clients)
+	for i := 0; i < clients; i++ {
+		nc, err := nats.Connect(srv.ClientURL())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(nc.Close)
+		conns = append(conns, nc)
+	}
+	return srv, conns
 }
 
 func NewTestConfig() *relayutil.Config {
@@ -41,6 +142,9 @@ func NewTestConfig() *relayutil.Config {
 			RPCEndpointURL:    "/rpc",
 			EnabledRPCModules: map[string][]string{"calculateSum": []string{"calculateSum"}},
 			IsTLSEnabled:      false,
+			RPCMethodSchemas: map[string]*relayutil.RPCMethodSchema{
+				"calculateSum_calculateSum": {Params: []*relayutil.RPCParamSchema{{Name: "a"}, {Name: "b"}}},
+			},
 		},
 		Ingress: &relayutil.IngressConfig{
 			Host:                           "localhost",
@@ -63,39 +167,43 @@ func NewTestConfig() *relayutil.Config {
 }
 
 type RelayFixture struct {
-	NATSTestServer    *gnatsd.Server
+	NATSTestServer    *natsserver.Server
 	JRPCHTTPServer    *http.Server
 	EgressServer      *egress.Server
 	IngressHTTPServer *http.Server
 	IngressServer     *ingress.Server
 }
 
-func NewJRPCServer(t *testing.T, config *relayutil.Config) *http.Server {
-	srv, err := jrpcserver.NewServer(config)
+// ServeTestHTTP binds the address before returning so that requests made right after the fixture
+// is created don't race with the listener startup
+func ServeTestHTTP(t *testing.T, addr string, handler http.Handler) *http.Server {
+	listener, err := net.Listen("tcp", addr)
 	if err != nil {
 		t.Fatal(err)
 	}
-	httpSrv := &http.Server{Addr: config.JRPCServer.GetHostWithPort(), Handler: srv}
+	httpSrv := &http.Server{Addr: addr, Handler: handler}
 	go func() {
-		if err := httpSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			t.Fatal(err)
+		if err := httpSrv.Serve(listener); err != nil && err != http.ErrServerClosed {
+			t.Error(err)
 		}
 	}()
 	return httpSrv
 }
 
+func NewJRPCServer(t *testing.T, config *relayutil.Config) *http.Server {
+	srv, err := jrpcserver.NewServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ServeTestHTTP(t, config.JRPCServer.GetHostWithPort(), srv)
+}
+
 func NewIngressServer(t *testing.T, config *relayutil.Config) (*http.Server, *ingress.Server) {
 	srv, err := ingress.NewServer(config)
 	if err != nil {
 		t.Fatal(err)
 	}
-	httpSrv := &http.Server{Addr: config.Ingress.GetHostWithPort(), Handler: srv}
-	go func() {
-		if err := httpSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			t.Fatal(err)
-		}
-	}()
-	return httpSrv, srv
+	return ServeTestHTTP(t, config.Ingress.GetHostWithPort(), srv), srv
 }
 
 func NewRelayFixture(t *testing.T, config *relayutil.Config) *RelayFixture {
@@ -135,3 +243,93 @@ func (fixture *RelayFixture) Shutdown() error {
 
 	return nil
 }
+
+// GetMemoryCache returns the in-memory request cache of the ingress server
+func GetMemoryCache(t *testing.T, srv *ingress.Server) *ingress.RequestCache {
+	cache, ok := srv.RequestCache.(*ingress.RequestCache)
+	if !ok {
+		t.Fatal("ingress server does not use the in-memory cache")
+	}
+	return cache
+}
+
+// TestJWTIssuer signs JWTs with an RSA key ("rsa") and an EC P-256 key ("ec") and serves the JWKS
+// with both public keys
+type TestJWTIssuer struct {
+	RSAKey     *rsa.PrivateKey
+	ECKey      *ecdsa.PrivateKey
+	JWKSServer *httptest.Server
+	// Number of JWKS requests served
+	JWKSRequests int32
+	// Time the JWKS requests take, in nanoseconds
+	JWKSDelay int64
+}
+
+func NewTestJWTIssuer(t *testing.T) *TestJWTIssuer {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer := &TestJWTIssuer{RSAKey: rsaKey, ECKey: ecKey}
+	issuer.JWKSServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		atomic.AddInt32(&issuer.JWKSRequests, 1)
+		time.Sleep(time.Duration(atomic.LoadInt64(&issuer.JWKSDelay)))
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(issuer.JWKS())
+	}))
+	t.Cleanup(issuer.JWKSServer.Close)
+	return issuer
+}
+
+// JWKS returns the JSON Web Key Set with the public keys of the issuer
+func (issuer *TestJWTIssuer) JWKS() []byte {
+	encode := base64.RawURLEncoding.EncodeToString
+	ecPoint := func(value []byte) string {
+		padded := make([]byte, 32)
+		copy(padded[32-len(value):], value)
+		return encode(padded)
+	}
+	jwks, _ := json.Marshal(map[string]any{"keys": []map[string]string{
+		{"kty": "RSA", "kid": "rsa", "use": "sig", "alg": "RS256",
+			"n": encode(issuer.RSAKey.N.Bytes()), "e": encode([]byte{1, 0, 1})},
+		{"kty": "EC", "kid": "ec", "use": "sig", "alg": "ES256", "crv": "P-256",
+			"x": ecPoint(issuer.ECKey.X.Bytes()), "y": ecPoint(issuer.ECKey.Y.Bytes())},
+	}})
+	return jwks
+}
+
+// Sign creates a JWT with the claims signed with the key for the algorithm, either RS256 or ES256
+func (issuer *TestJWTIssuer) Sign(t *testing.T, alg string, kid string, claims map[string]any) string {
+	encode := base64.RawURLEncoding.EncodeToString
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signingInput := encode(header) + "." + encode(payload)
+	hashed := sha256.Sum256([]byte(signingInput))
+
+	var signature []byte
+	switch alg {
+	case "RS256":
+		signature, err = rsa.SignPKCS1v15(rand.Reader, issuer.RSAKey, crypto.SHA256, hashed[:])
+	case "ES256":
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, issuer.ECKey, hashed[:])
+		if err == nil {
+			signature = make([]byte, 64)
+			r.FillBytes(signature[:32])
+			s.FillBytes(signature[32:])
+		}
+	default:
+		signature = []byte("signature")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signingInput + "." + encode(signature)
+}